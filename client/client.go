@@ -2,11 +2,14 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,9 +29,20 @@ const ping = 10
 
 type client mirc.Client
 type conf struct {
-	Server string
+	Server     string
+	HideTyping bool `yaml:"hideTyping"`
 }
 
+// token to pick the session up again after the connection drops
+var resumeToken string
+
+// password of a registered nick, empty for guests
+var password string
+
+// guards the nick and socket of the client, the message loop changes them
+// while the keep alive loop and the gui use them
+var clientMu sync.Mutex
+
 // Initialize new client connection
 func newClient(server string) *client {
 	//conn, err := net.Dial("tcp", server)
@@ -38,7 +52,7 @@ func newClient(server string) *client {
 		// TODO: add error handleing, maybe ask for new server IP
 		os.Exit(-1)
 	}
-	con := mirc.Connection{conn}
+	con := mirc.Connection{Conn: conn}
 	new := client{
 		IP:     conn.LocalAddr(),
 		Room:   "public",
@@ -48,10 +62,38 @@ func newClient(server string) *client {
 	return &new
 }
 
+// nick returns the current nickname of the client
+func (c *client) nick() string {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return c.Nick
+}
+
+// setNickname sets the nickname of the client once the server accepted it
+func (c *client) setNickname(nick string) {
+	clientMu.Lock()
+	c.Nick = nick
+	clientMu.Unlock()
+}
+
+// socket returns the current connection to the server
+func (c *client) socket() *mirc.Connection {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	return c.Socket
+}
+
+// setSocket replaces the connection after the session was resumed
+func (c *client) setSocket(con *mirc.Connection) {
+	clientMu.Lock()
+	c.Socket = con
+	clientMu.Unlock()
+}
+
 // Generate new message object from opcode, receiver nick and message body
 func (c *client) newMsg(opCode int16, receiver string, body string) *mirc.Message {
 	msg := mirc.NewMsg(opCode, receiver, body)
-	msg.Header.Sender = c.Nick
+	msg.Header.Sender = c.nick()
 	return msg
 }
 
@@ -67,15 +109,23 @@ func (c *client) requestToConnect() error {
 		if i > 0 {
 			fmt.Printf("Retry connecting... (%d/%d)\n", i, retries)
 		}
-		msg := c.newServMsg(mirc.CLIENT_REQUEST_CONNECTION, c.Nick)
-		c.Socket.Conn.SetDeadline(mirc.CalDeadline(timeout))
-		err = c.Socket.SendMsg(msg)
+		msg := c.newServMsg(mirc.CLIENT_REQUEST_CONNECTION, c.nick())
+		if password != "" {
+			msg = c.newServMsg(mirc.CLIENT_LOGIN, c.nick()+" "+password)
+		}
+		c.socket().Conn.SetDeadline(mirc.CalDeadline(timeout))
+		err = c.socket().SendMsg(msg)
 		if err != nil {
 			fmt.Printf("%s\n", err)
 		} else {
 			// request new nickname if exisit in server
-			c.Socket.Conn.SetDeadline(mirc.CalDeadline(timeout))
-			opCode, msg := c.Socket.GetMsg()
+			c.socket().Conn.SetDeadline(mirc.CalDeadline(timeout))
+			opCode, msg := c.socket().GetMsg()
+			if opCode == mirc.CONNECTION_CLOSED {
+				// server refused the connection
+				fmt.Printf("Cannot connect: %s\n", msg.Body)
+				os.Exit(-1)
+			}
 			if opCode == mirc.CONNECTION_FAILURE {
 				fmt.Printf("Cannot connect: %s\n", msg.Body)
 				c.changeNick(setNick())
@@ -87,24 +137,83 @@ func (c *client) requestToConnect() error {
 	return err
 }
 
+// resume reconnects to the server and picks the session up with the resume
+// token, messages missed in the meantime are replayed by the server
+func (c *client) resume() error {
+	if resumeToken == "" {
+		return errors.New("no resume token")
+	}
+	server := c.socket().RemoteAddr().String()
+	conn, err := net.DialTimeout("tcp", server, dialTimeout*time.Second)
+	if err != nil {
+		return err
+	}
+	con := &mirc.Connection{Conn: conn}
+	con.Conn.SetDeadline(mirc.CalDeadline(timeout))
+	if err := con.SendMsg(c.newServMsg(mirc.CLIENT_RESUME, resumeToken)); err != nil {
+		conn.Close()
+		return err
+	}
+	opCode, msg := con.GetMsg()
+	if opCode != mirc.CONNECTION_SUCCESS {
+		conn.Close()
+		if opCode == mirc.ERROR {
+			return errors.New("no reply from server")
+		}
+		return errors.New(msg.Body)
+	}
+	c.setSocket(con)
+	// capabilities belong to the connection, turn them off again
+	if hideTyping {
+		c.setCaps("-typing")
+	}
+	return nil
+}
+
+// reconnect tries to resume the session a few times after the connection
+// was lost
+func (c *client) reconnect(g *gocui.Gui) bool {
+	for i := 1; i <= retries && resumeToken != ""; i++ {
+		time.Sleep(time.Second)
+		err := c.resume()
+		g.Execute(func(g *gocui.Gui) error {
+			v, verr := g.View("view")
+			if verr != nil {
+				return verr
+			}
+			if err != nil {
+				printf(v, "\nReconnecting failed (%d/%d): %s\n", i, retries, err)
+			} else {
+				printf(v, "\nConnection lost, session resumed\n")
+			}
+			return nil
+		})
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 // closeConnection sends a close connection request to the server
 func (c *client) closeConnection() {
 	reqMsg := c.newServMsg(mirc.CONNECTION_CLOSED, "")
-	c.Socket.SendMsg(reqMsg)
+	c.socket().SendMsg(reqMsg)
 	return
 }
 
-// Sets nickname locally
+// Sets nickname locally, a registered nick is followed by its password
 func setNick() string {
-	fmt.Print("Input your nickname:")
+	fmt.Print("Input your nickname (and password if it's registered):")
 	reader := bufio.NewReader(os.Stdin)
-	nick, _ := reader.ReadString('\n')
-	nick = strings.Replace(nick, "\n", "", -1)
-	for len(nick) <= 0 {
-		fmt.Print("Input a valid nickname:")
-		nick, _ = reader.ReadString('\n')
-		nick = strings.Replace(nick, "\n", "", -1)
+	line, _ := reader.ReadString('\n')
+	nick, pass := comParser(strings.Replace(line, "\n", "", -1))
+	for err := mirc.ValidateNick(nick); err != nil; err = mirc.ValidateNick(nick) {
+		fmt.Printf("%s\nInput a valid nickname:", err)
+		line, _ = reader.ReadString('\n')
+		nick, pass = comParser(strings.Replace(line, "\n", "", -1))
 	}
+	password = pass
 	return nick
 }
 
@@ -116,11 +225,12 @@ func (c *client) changeNick(nick string) {
 	opCode = mirc.CONNECTION_FAILURE
 	for opCode == mirc.CONNECTION_FAILURE {
 		msg = c.newServMsg(mirc.CLIENT_CHANGE_NICK, nick)
-		c.Socket.Conn.SetDeadline(mirc.CalDeadline(timeout))
-		c.Socket.SendMsg(msg)
-		opCode, msg = c.Socket.GetMsg()
+		con := c.socket()
+		con.Conn.SetDeadline(mirc.CalDeadline(timeout))
+		con.SendMsg(msg)
+		opCode, msg = con.GetMsg()
 		if opCode == mirc.CONNECTION_SUCCESS {
-			c.Nick = nick
+			c.setNickname(nick)
 		} else {
 			fmt.Printf("Error: %s\n", msg.Body)
 		}
@@ -128,54 +238,243 @@ func (c *client) changeNick(nick string) {
 	return
 }
 
-// listRoom lists all rooms in the server
-func (c *client) listRoom() error {
-	reqMsg := c.newServMsg(mirc.CLIENT_LIST_ROOM, "")
-	return c.Socket.SendMsg(reqMsg)
+// listRoom lists the rooms in the server, query holds an optional name
+// pattern and the sort and page options
+func (c *client) listRoom(query string) error {
+	reqMsg := c.newServMsg(mirc.CLIENT_LIST_ROOM, query)
+	return c.socket().SendMsg(reqMsg)
 }
 
 // listMember lists all members in a room
 func (c *client) listMember(room string) error {
 	reqMsg := c.newServMsg(mirc.CLIENT_LIST_MEMBER, room)
-	return c.Socket.SendMsg(reqMsg)
+	return c.socket().SendMsg(reqMsg)
 }
 
 // send a request to create a room to server
 func (c *client) createRoom(room string) error {
 	//fmt.Printf("requesting new room %s\n", room)
 	msg := c.newServMsg(mirc.CLIENT_CREATE_ROOM, room)
-	return c.Socket.SendMsg(msg)
+	return c.socket().SendMsg(msg)
 }
 
 // send a request to join a room to server
 func (c *client) joinRoom(room string) error {
 	msg := c.newServMsg(mirc.CLIENT_JOIN_ROOM, room)
-	return c.Socket.SendMsg(msg)
+	return c.socket().SendMsg(msg)
 }
 
 // changeRoom if input room exists in the server and the client is
 // a memeber to that room then change the current room to that
 func (c *client) changeRoom(room string) error {
 	reqMsg := c.newServMsg(mirc.CLIENT_IN_ROOM, room)
-	return c.Socket.SendMsg(reqMsg)
+	return c.socket().SendMsg(reqMsg)
 }
 
 // send a request to leave a room
 func (c *client) leaveRoom(room string) error {
 	msg := c.newServMsg(mirc.CLIENT_LEAVE_ROOM, room)
-	return c.Socket.SendMsg(msg)
+	return c.socket().SendMsg(msg)
 }
 
 // send a private message to a client
 func (c *client) sendPrivateMsg(receiver string, msgBody string) error {
 	msg := c.newMsg(mirc.CLIENT_SEND_MESSAGE, receiver, msgBody)
-	return c.Socket.SendMsg(msg)
+	return c.socket().SendMsg(msg)
 }
 
 // send a private message to a client
 func (c *client) sendPubMsg(msgBody string) error {
 	msg := c.newMsg(mirc.CLIENT_SEND_PUB_MESSAGE, c.Room, msgBody)
-	return c.Socket.SendMsg(msg)
+	return c.socket().SendMsg(msg)
+}
+
+// log in as a server operator
+func (c *client) oper(name string, password string) error {
+	msg := c.newServMsg(mirc.CLIENT_OPER, name+" "+password)
+	return c.socket().SendMsg(msg)
+}
+
+// ask the server to disconnect a client
+func (c *client) kill(nick string, reason string) error {
+	msg := c.newMsg(mirc.CLIENT_KILL, nick, reason)
+	return c.socket().SendMsg(msg)
+}
+
+// send a message to every client on the server
+func (c *client) wall(msgBody string) error {
+	msg := c.newServMsg(mirc.CLIENT_WALL, msgBody)
+	return c.socket().SendMsg(msg)
+}
+
+// ask the server to delete a room
+func (c *client) deleteRoom(room string) error {
+	msg := c.newServMsg(mirc.CLIENT_DELETE_ROOM, room)
+	return c.socket().SendMsg(msg)
+}
+
+// ask the server to add a client to a room
+func (c *client) forceJoin(nick string, room string) error {
+	msg := c.newMsg(mirc.CLIENT_FORCE_JOIN, nick, room)
+	return c.socket().SendMsg(msg)
+}
+
+// ask the server to remove a client from a room
+func (c *client) forcePart(nick string, room string) error {
+	msg := c.newMsg(mirc.CLIENT_FORCE_PART, nick, room)
+	return c.socket().SendMsg(msg)
+}
+
+// ban an address or range from the server
+func (c *client) ban(address string) error {
+	msg := c.newServMsg(mirc.CLIENT_BAN, address)
+	return c.socket().SendMsg(msg)
+}
+
+// lift a ban
+func (c *client) unban(address string) error {
+	msg := c.newServMsg(mirc.CLIENT_UNBAN, address)
+	return c.socket().SendMsg(msg)
+}
+
+// list the bans on the server
+func (c *client) listBans() error {
+	msg := c.newServMsg(mirc.CLIENT_LIST_BANS, "")
+	return c.socket().SendMsg(msg)
+}
+
+// create an incoming webhook posting into a room as sender
+func (c *client) createHook(room string, sender string) error {
+	msg := c.newMsg(mirc.CLIENT_CREATE_HOOK, room, sender)
+	return c.socket().SendMsg(msg)
+}
+
+// revoke an incoming webhook
+func (c *client) revokeHook(token string) error {
+	msg := c.newServMsg(mirc.CLIENT_REVOKE_HOOK, token)
+	return c.socket().SendMsg(msg)
+}
+
+// list the incoming webhooks on the server
+func (c *client) listHooks() error {
+	msg := c.newServMsg(mirc.CLIENT_LIST_HOOKS, "")
+	return c.socket().SendMsg(msg)
+}
+
+// schedule a message to a room, or to everyone for "*", spec holds the
+// schedule followed by the message
+func (c *client) schedule(room string, spec string) error {
+	msg := c.newMsg(mirc.CLIENT_SCHEDULE, room, spec)
+	return c.socket().SendMsg(msg)
+}
+
+// delete a scheduled message
+func (c *client) unschedule(id string) error {
+	msg := c.newServMsg(mirc.CLIENT_UNSCHEDULE, id)
+	return c.socket().SendMsg(msg)
+}
+
+// list the scheduled messages on the server
+func (c *client) listSchedules() error {
+	msg := c.newServMsg(mirc.CLIENT_LIST_SCHEDULES, "")
+	return c.socket().SendMsg(msg)
+}
+
+// stop receiving messages from a nick
+func (c *client) ignore(nick string) error {
+	msg := c.newServMsg(mirc.CLIENT_IGNORE, nick)
+	return c.socket().SendMsg(msg)
+}
+
+// receive messages from an ignored nick again
+func (c *client) unignore(nick string) error {
+	msg := c.newServMsg(mirc.CLIENT_UNIGNORE, nick)
+	return c.socket().SendMsg(msg)
+}
+
+// list the nicks we ignore
+func (c *client) listIgnores() error {
+	msg := c.newServMsg(mirc.CLIENT_LIST_IGNORES, "")
+	return c.socket().SendMsg(msg)
+}
+
+// mark this client as away, an empty message marks it back
+func (c *client) away(message string) error {
+	msg := c.newServMsg(mirc.CLIENT_AWAY, message)
+	return c.socket().SendMsg(msg)
+}
+
+// change nickname while connected
+func (c *client) rename(nick string) error {
+	msg := c.newServMsg(mirc.CLIENT_CHANGE_NICK, nick)
+	return c.socket().SendMsg(msg)
+}
+
+// change the text of a room message
+func (c *client) editMsg(ref msgRef, text string) error {
+	msg := c.newMsg(mirc.CLIENT_EDIT_MESSAGE, ref.room, strconv.FormatInt(ref.id, 10)+" "+text)
+	return c.socket().SendMsg(msg)
+}
+
+// retract a room message
+func (c *client) deleteMsg(ref msgRef) error {
+	msg := c.newMsg(mirc.CLIENT_DELETE_MESSAGE, ref.room, strconv.FormatInt(ref.id, 10))
+	return c.socket().SendMsg(msg)
+}
+
+// reply to a room message in its thread
+func (c *client) reply(ref msgRef, msgBody string) error {
+	msg := c.newMsg(mirc.CLIENT_SEND_PUB_MESSAGE, ref.room, msgBody)
+	msg.Header.Parent = ref.id
+	return c.socket().SendMsg(msg)
+}
+
+// fetch the thread of a room message
+func (c *client) getThread(ref msgRef) error {
+	msg := c.newMsg(mirc.CLIENT_GET_THREAD, ref.room, strconv.FormatInt(ref.id, 10))
+	return c.socket().SendMsg(msg)
+}
+
+// search the history of a room, or of all our rooms when room is empty
+func (c *client) search(room string, query string) error {
+	msg := c.newMsg(mirc.CLIENT_SEARCH, room, query)
+	return c.socket().SendMsg(msg)
+}
+
+// set the topic of a room
+func (c *client) setTopic(room string, topic string) error {
+	msg := c.newMsg(mirc.CLIENT_SET_TOPIC, room, topic)
+	return c.socket().SendMsg(msg)
+}
+
+// change the modes of a room, like "+s" or "-t"
+func (c *client) setMode(room string, change string) error {
+	msg := c.newMsg(mirc.CLIENT_SET_MODE, room, change)
+	return c.socket().SendMsg(msg)
+}
+
+// list the messages that mentioned us, "clear" empties the list
+func (c *client) listMentions(arg string) error {
+	msg := c.newServMsg(mirc.CLIENT_LIST_MENTIONS, arg)
+	return c.socket().SendMsg(msg)
+}
+
+// turn optional server features on or off, "-name" turns one off
+func (c *client) setCaps(caps string) error {
+	msg := c.newServMsg(mirc.CLIENT_CAPS, caps)
+	return c.socket().SendMsg(msg)
+}
+
+// register the current nickname with a password
+func (c *client) register(password string) error {
+	msg := c.newServMsg(mirc.CLIENT_REGISTER, password)
+	return c.socket().SendMsg(msg)
+}
+
+// ask the server about a nick
+func (c *client) whois(nick string) error {
+	msg := c.newServMsg(mirc.CLIENT_WHOIS, nick)
+	return c.socket().SendMsg(msg)
 }
 
 /*********** Helper functions ************/
@@ -196,7 +495,7 @@ func getConf(config *conf) {
 func (c *client) keepAliveLoop() {
 	keepAliveMsg := c.newServMsg(mirc.CONNECTION_PING, "ping")
 	for {
-		c.Socket.SendMsg(keepAliveMsg)
+		c.socket().SendMsg(keepAliveMsg)
 		time.Sleep(ping * time.Second)
 	}
 }
@@ -213,6 +512,30 @@ func comParser(cmdLine string) (string, string) {
 	return cmd, arg
 }
 
+// formatWhois turns a whois reply into lines for the view
+func formatWhois(body string) string {
+	var info mirc.ClientInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		return "invalid whois reply\n"
+	}
+	out := fmt.Sprintf("\n%s\n  rooms:     %s\n", info.Nick, strings.Join(info.Rooms, ", "))
+	// linked servers don't share connection times, only show them for local users
+	if info.Server == "" {
+		out += "  connected: " + info.Connected.Local().Format("Jan 2 03:04 PM") + "\n"
+		out += "  idle:      " + (time.Duration(info.IdleSeconds) * time.Second).String() + "\n"
+	}
+	if info.Away != "" {
+		out += "  away:      " + info.Away + "\n"
+	}
+	if info.Server != "" {
+		out += "  server:    " + info.Server + "\n"
+	}
+	if info.IP != "" {
+		out += "  address:   " + info.IP + "\n"
+	}
+	return out
+}
+
 /*********** UI functions ************/
 func main() {
 	config := conf{}
@@ -221,6 +544,10 @@ func main() {
 	currentClient := newClient(config.Server)
 	// Initialize Connection
 	currentClient.requestToConnect()
+	if config.HideTyping {
+		hideTyping = true
+		currentClient.setCaps("-typing")
+	}
 	go currentClient.keepAliveLoop()
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
@@ -239,12 +566,20 @@ func main() {
 		displayHelp(g)
 	}
 
+	if sv, err := g.SetView("status", 2, maxY-8, maxX-2, maxY-6); err != nil {
+		if err != gocui.ErrUnknownView {
+			fmt.Printf("Error: %s\n", err)
+		}
+		sv.Frame = false
+	}
+
 	if iv, err := g.SetView("input", 2, maxY-6, maxX-2, maxY-1); err != nil {
 		if err != gocui.ErrUnknownView {
 			fmt.Printf("Error: %s\n", err)
 		}
-		iv.Title = currentClient.Nick
+		iv.Title = currentClient.nick()
 		iv.Editable = true
+		iv.Editor = gocui.EditorFunc(currentClient.typingEditor)
 		err = iv.SetCursor(0, 0)
 		_, err = g.SetCurrentView("input")
 		if err != nil {
@@ -276,15 +611,51 @@ func displayHelp(g *gocui.Gui) {
 		helpMsg := "\nUSAGE EXAMPLE:\n" +
 			"create a room:          \\create roomName\n" +
 			"join a room:            \\join roomName\n" +
-			"list all rooms:         \\listRoom\n" +
+			"list rooms:             \\listRoom [pattern|/regexp/] [sort:members|created] [page:2]\n" +
 			"change current room:    \\changeRoom roomName\n" +
 			"list members of a room: \\listMember roomName\n" +
 			"leave a room:           \\leave roomName\n" +
+			"set the topic of a room:\\topic roomName topic\n" +
+			"change room modes:      \\mode roomName +s|-s|+t|-t\n" +
 			"send private message:   @nick message\n" +
+			"edit a room message:    \\edit #number new text\n" +
+			"delete a room message:  \\delete #number\n" +
+			"reply in a thread:      \\reply #number message\n" +
+			"open a thread:          \\thread #number\n" +
+			"close the thread pane:  \\closeThread\n" +
+			"change your nickname:   \\nick newname\n" +
+			"register your nickname: \\register password\n" +
+			"show details of a user: \\whois nick\n" +
+			"typing notifications:   \\typing on|off\n" +
+			"messages mentioning you:\\mentions [clear]\n" +
+			"search messages:        \\search [room] words from:nick after:2006-01-02 before:2006-01-02 page:2\n" +
+			"ignore a nick:          \\ignore nick\n" +
+			"stop ignoring a nick:   \\unignore nick\n" +
+			"list ignored nicks:     \\ignorelist\n" +
+			"mark yourself away:     \\away [message]\n" +
+			"mark yourself back:     \\back\n" +
 			"display this message:   \\help\n" +
-			"exit:                   \\exit\n"
+			"exit:                   \\exit\n" +
+			"\nOPERATOR COMMANDS:\n" +
+			"log in as operator:     \\oper name password\n" +
+			"disconnect a client:    \\kill nick [reason]\n" +
+			"message everyone:       \\wall message\n" +
+			"delete a room:          \\deleteRoom roomName\n" +
+			"keep an empty room:     \\mode roomName +P\n" +
+			"add client to a room:   \\forceJoin nick roomName\n" +
+			"remove client from room:\\forcePart nick roomName\n" +
+			"ban address or range:   \\ban 10.0.0.0/8\n" +
+			"lift a ban:             \\unban 10.0.0.0/8\n" +
+			"list bans:              \\bans\n" +
+			"create incoming webhook:\\hookCreate roomName botName\n" +
+			"revoke incoming webhook:\\hookRevoke token\n" +
+			"list incoming webhooks: \\hooks\n" +
+			"schedule a message:     \\schedule roomName|* weekdays 09:55 message\n" +
+			"                        \\schedule roomName|* every 2h message\n" +
+			"delete a schedule:      \\unschedule number\n" +
+			"list schedules:         \\schedules\n"
 
-		fmt.Fprintf(v, helpMsg)
+		printf(v, "%s", helpMsg)
 		return nil
 	})
 	return
@@ -299,20 +670,85 @@ func (c *client) msgHandlerLoop(g *gocui.Gui) {
 
 // Handles an incoming message
 func (c *client) msgHandler(g *gocui.Gui) int {
-	c.Socket.SetDeadline(mirc.CalDeadline(timeout))
-	opCode, msg := c.Socket.GetMsg()
+	con := c.socket()
+	con.SetDeadline(mirc.CalDeadline(timeout))
+	opCode, msg := con.GetMsg()
 
 	if opCode == mirc.ERROR {
+		if c.reconnect(g) {
+			return 0
+		}
 		g.Close()
 		fmt.Print("Server connection has lost...Client exited\n")
 		os.Exit(0)
+	} else if opCode == mirc.SERVER_RESUME_TOKEN {
+		resumeToken = msg.Body
 	} else if opCode == mirc.SERVER_BROADCAST_MESSAGE {
 		g.Execute(func(g *gocui.Gui) error {
 			v, err := g.View("view")
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "\n%s [%s] %s: %s\n", mirc.GetTime(), msg.Header.Receiver, msg.Header.Sender, msg.Body)
+			if printRoomMsg(g, v, msg, c.nick()) {
+				// ring the terminal bell
+				fmt.Print("\a")
+			}
+			c.stopTyping(g, msg)
+			c.countUnread(g, msg)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_MESSAGE_EDITED || opCode == mirc.SERVER_MESSAGE_DELETED {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			amendRoomMsg(v, msg)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_THREAD {
+		g.Execute(func(g *gocui.Gui) error {
+			if err := openThread(g, msg.Body); err != nil {
+				v, _ := g.View("view")
+				printf(v, "\n%s\n", err)
+			}
+			return nil
+		})
+	} else if opCode == mirc.SERVER_TYPING {
+		g.Execute(func(g *gocui.Gui) error {
+			c.showTyping(g, msg)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_READ_MARKER {
+		g.Execute(func(g *gocui.Gui) error {
+			c.updateMarker(g, msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_SEARCH {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "%s", formatSearch(msg.Body))
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_MENTIONS {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "%s", formatMentions(msg.Body))
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_CAPS {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "Capabilities: %s\n", msg.Body)
 			return nil
 		})
 	} else if opCode == mirc.SERVER_TELL_MESSAGE {
@@ -321,7 +757,13 @@ func (c *client) msgHandler(g *gocui.Gui) int {
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "\n%s [PRIVATE] %s: %s\n", mirc.GetTime(), msg.Header.Sender, msg.Body)
+			c.stopTyping(g, msg)
+			if msg.Header.Sender == c.nick() && msg.Header.Receiver != c.nick() {
+				// sent from another device
+				printf(v, "\n%s [PRIVATE] %s -> %s: %s\n", mirc.GetTime(), c.nick(), msg.Header.Receiver, msg.Body)
+			} else {
+				printf(v, "\n%s [PRIVATE] %s: %s\n", mirc.GetTime(), msg.Header.Sender, msg.Body)
+			}
 			return nil
 		})
 	} else if opCode == mirc.CONNECTION_CLOSED {
@@ -330,18 +772,85 @@ func (c *client) msgHandler(g *gocui.Gui) int {
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "Server connection closed, client exiting...\n")
+			printf(v, "Server connection closed, client exiting...\n")
 			return nil
 		})
 		g.Close()
 		os.Exit(0)
+	} else if opCode == mirc.SERVER_WALL_MESSAGE {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "\n%s [WALL] %s: %s\n", mirc.GetTime(), msg.Header.Sender, msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_LIST_BANS {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "Bans: %s\n", msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_LIST_HOOKS {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "Webhooks: %s\n", msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_LIST_IGNORES {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "Ignored: %s\n", msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_LIST_SCHEDULES {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "Schedules: %s\n", msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_NICK {
+		g.Execute(func(g *gocui.Gui) error {
+			c.setNickname(msg.Header.Receiver)
+			if iv, err := g.View("input"); err == nil {
+				iv.Title = c.nick()
+			}
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "\n%s\n", msg.Body)
+			return nil
+		})
+	} else if opCode == mirc.SERVER_RPL_WHOIS {
+		g.Execute(func(g *gocui.Gui) error {
+			v, err := g.View("view")
+			if err != nil {
+				return err
+			}
+			printf(v, "%s", formatWhois(msg.Body))
+			return nil
+		})
 	} else if opCode == mirc.SERVER_RPL_LIST_ROOM {
 		g.Execute(func(g *gocui.Gui) error {
 			v, err := g.View("view")
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "Rooms available: %s\n", msg.Body)
+			printf(v, "%s", formatRooms(msg.Body))
 			return nil
 		})
 	} else if opCode == mirc.SERVER_RPL_LIST_MEMBER {
@@ -350,7 +859,7 @@ func (c *client) msgHandler(g *gocui.Gui) int {
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "Members: %s\n", msg.Body)
+			printf(v, "Members: %s\n", msg.Body)
 			return nil
 		})
 	} else if opCode == mirc.SERVER_RPL_CLIENT_IN_ROOM {
@@ -360,8 +869,9 @@ func (c *client) msgHandler(g *gocui.Gui) int {
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "current Room: %s\n", c.Room)
-			v.Title = c.Room
+			printf(v, "current Room: %s\n", c.Room)
+			c.drawTitle(g)
+			c.jumpToUnread(g)
 			return nil
 		})
 	}
@@ -374,6 +884,10 @@ func (c *client) inputFunc(g *gocui.Gui, iv *gocui.View) error {
 	cmdLine := iv.ViewBuffer()
 	v.Clear()
 	v.SetCursor(0, 0)
+	// follow new messages again after jumping to unread ones
+	if lv, err := g.View("view"); err == nil {
+		lv.Autoscroll = true
+	}
 	cmd, arg := comParser(cmdLine)
 	if len(cmd) == 0 { // ignore empty input
 		return nil
@@ -384,7 +898,13 @@ func (c *client) inputFunc(g *gocui.Gui, iv *gocui.View) error {
 	} else if cmd == "\\join" { // join a chat room
 		c.joinRoom(arg)
 	} else if cmd == "\\listRoom" { // list all char rooms on a server
-		c.listRoom()
+		c.listRoom(arg)
+	} else if cmd == "\\topic" { // set the topic of a room
+		room, topic := comParser(arg)
+		c.setTopic(room, topic)
+	} else if cmd == "\\mode" { // change the modes of a room
+		room, change := comParser(arg)
+		c.setMode(room, change)
 	} else if cmd == "\\changeRoom" { // change current chat room
 		c.changeRoom(arg)
 	} else if cmd == "\\listMember" { // list membership of a room
@@ -392,13 +912,108 @@ func (c *client) inputFunc(g *gocui.Gui, iv *gocui.View) error {
 	} else if cmd == "\\leave" { // leave room
 		c.leaveRoom(arg)
 		c.Room = "public"
+	} else if cmd == "\\oper" { // log in as server operator
+		name, password := comParser(arg)
+		c.oper(name, password)
+	} else if cmd == "\\kill" { // disconnect a client
+		nick, reason := comParser(arg)
+		c.kill(nick, reason)
+	} else if cmd == "\\wall" { // message every client on the server
+		c.wall(arg)
+	} else if cmd == "\\deleteRoom" { // delete a chat room
+		c.deleteRoom(arg)
+	} else if cmd == "\\forceJoin" { // add a client to a chat room
+		nick, room := comParser(arg)
+		c.forceJoin(nick, room)
+	} else if cmd == "\\forcePart" { // remove a client from a chat room
+		nick, room := comParser(arg)
+		c.forcePart(nick, room)
+	} else if cmd == "\\ban" { // ban an address or range
+		c.ban(arg)
+	} else if cmd == "\\unban" { // lift a ban
+		c.unban(arg)
+	} else if cmd == "\\bans" { // list bans
+		c.listBans()
+	} else if cmd == "\\hookCreate" { // create an incoming webhook
+		room, sender := comParser(arg)
+		c.createHook(room, sender)
+	} else if cmd == "\\hookRevoke" { // revoke an incoming webhook
+		c.revokeHook(arg)
+	} else if cmd == "\\hooks" { // list incoming webhooks
+		c.listHooks()
+	} else if cmd == "\\schedule" { // schedule a message
+		room, spec := comParser(arg)
+		c.schedule(room, spec)
+	} else if cmd == "\\unschedule" { // delete a scheduled message
+		c.unschedule(arg)
+	} else if cmd == "\\schedules" { // list scheduled messages
+		c.listSchedules()
+	} else if cmd == "\\reply" || cmd == "\\thread" { // threads
+		num, text := comParser(arg)
+		ref, err := lookupRef(num)
+		if err != nil {
+			v, _ := g.View("view")
+			printf(v, "\n%s\n", err)
+		} else if cmd == "\\reply" {
+			c.reply(ref, text)
+		} else {
+			c.getThread(ref)
+		}
+	} else if cmd == "\\search" { // search message history
+		room, query := comParser(arg)
+		if _, ok := readMarkers[strings.ToLower(room)]; !ok {
+			// not one of our rooms, search all of them
+			room, query = "", arg
+		}
+		c.search(room, query)
+	} else if cmd == "\\mentions" { // list mentions
+		c.listMentions(arg)
+	} else if cmd == "\\typing" { // typing notifications
+		hideTyping = arg == "off"
+		if hideTyping {
+			c.setCaps("-typing")
+		} else {
+			c.setCaps("typing")
+		}
+	} else if cmd == "\\closeThread" { // close the thread pane
+		closeThread(g)
+	} else if cmd == "\\edit" || cmd == "\\delete" { // change a room message
+		num, text := comParser(arg)
+		ref, err := lookupRef(num)
+		if err != nil {
+			v, _ := g.View("view")
+			printf(v, "\n%s\n", err)
+		} else if cmd == "\\edit" {
+			c.editMsg(ref, text)
+		} else {
+			c.deleteMsg(ref)
+		}
+	} else if cmd == "\\register" { // register nickname
+		c.register(arg)
+	} else if cmd == "\\nick" { // change nickname
+		c.rename(arg)
+	} else if cmd == "\\whois" { // show details of a user
+		c.whois(arg)
+	} else if cmd == "\\ignore" { // ignore a nick
+		c.ignore(arg)
+	} else if cmd == "\\unignore" { // stop ignoring a nick
+		c.unignore(arg)
+	} else if cmd == "\\ignorelist" { // list ignored nicks
+		c.listIgnores()
+	} else if cmd == "\\away" { // mark as away
+		if arg == "" {
+			arg = "away"
+		}
+		c.away(arg)
+	} else if cmd == "\\back" { // mark as back
+		c.away("")
 	} else if cmd[0] == '@' { // Private user message
 		g.Execute(func(g *gocui.Gui) error {
 			v, err := g.View("view")
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(v, "\n%s [PRIVATE] %s: %s\n", mirc.GetTime(), c.Nick, arg)
+			printf(v, "\n%s [PRIVATE] %s: %s\n", mirc.GetTime(), c.nick(), arg)
 			return nil
 		})
 		c.sendPrivateMsg(cmd[1:], arg)
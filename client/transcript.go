@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	"github.com/shaynewang/mirc"
+)
+
+// The view is drawn again from the transcript when a message is edited or
+// deleted, so everything shown in it goes through the transcript. Room
+// messages are numbered, the numbers are used to refer to them in commands.
+// A thread can be opened in a pane next to the view, replies to it show up
+// there as well. Messages mentioning us are highlighted.
+
+/******************** types ********************/
+// roomLine is a room message shown in the view
+type roomLine struct {
+	line    int
+	ref     int
+	time    string
+	room    string
+	sender  string
+	body    string
+	parent  int64
+	replies int
+	edited  bool
+	deleted bool
+	mention bool
+}
+
+// msgRef is the message a number shown in the view stands for
+type msgRef struct {
+	id   int64
+	room string
+}
+type transcript struct {
+	lines []string
+	byID  map[int64]*roomLine
+	refs  []msgRef
+	// id of the first message of the thread open in the pane, 0 if none
+	thread int64
+}
+
+// terminal colors of highlighted lines
+const highlight = "\x1b[1;33m"
+const resetColor = "\x1b[0m"
+
+/********************* Globals ******************/
+
+// what the view shows, only touched from the gui goroutine
+var shown = transcript{
+	byID: map[int64]*roomLine{},
+}
+
+/*********** Transcript functions ************/
+// printf adds a line to the transcript and shows it
+func printf(v *gocui.View, format string, a ...interface{}) {
+	line := fmt.Sprintf(format, a...)
+	shown.lines = append(shown.lines, line)
+	fmt.Fprint(v, line)
+}
+
+// format renders a room message with its number
+func (rl *roomLine) format() string {
+	body := rl.body
+	if rl.deleted {
+		body = "(message deleted)"
+	} else if rl.edited {
+		body += " (edited)"
+	}
+	if root, ok := shown.byID[rl.parent]; ok && rl.parent != 0 {
+		body = fmt.Sprintf("(re #%d) %s", root.ref, body)
+	} else if rl.parent != 0 {
+		body = "(reply) " + body
+	}
+	if rl.replies == 1 {
+		body += " [1 reply]"
+	} else if rl.replies > 1 {
+		body += fmt.Sprintf(" [%d replies]", rl.replies)
+	}
+	line := fmt.Sprintf("%s [%s] %s: %s", rl.time, rl.room, rl.sender, body)
+	if rl.ref != 0 {
+		line = fmt.Sprintf("%s [%s] #%d %s: %s", rl.time, rl.room, rl.ref, rl.sender, body)
+	}
+	if rl.mention {
+		line = highlight + line + resetColor
+	}
+	return "\n" + line + "\n"
+}
+
+// redraw draws the view again from the transcript
+func redraw(v *gocui.View) {
+	v.Clear()
+	fmt.Fprint(v, strings.Join(shown.lines, ""))
+}
+
+// printRoomMsg shows a room message and numbers it, a reply also bumps the
+// reply count of its thread and goes to the thread pane if the thread is open.
+// It reports whether the message mentions nick
+func printRoomMsg(g *gocui.Gui, v *gocui.View, msg *mirc.Message, nick string) bool {
+	rl := &roomLine{
+		line:    len(shown.lines),
+		time:    mirc.GetTime(),
+		room:    msg.Header.Receiver,
+		sender:  msg.Header.Sender,
+		body:    msg.Body,
+		parent:  msg.Header.Parent,
+		mention: msg.Header.Sender != nick && mirc.Mentioned(msg.Body, nick),
+	}
+	if msg.Header.ID != 0 {
+		shown.refs = append(shown.refs, msgRef{id: msg.Header.ID, room: msg.Header.Receiver})
+		rl.ref = len(shown.refs)
+		shown.byID[msg.Header.ID] = rl
+	}
+	printf(v, "%s", rl.format())
+	if root, ok := shown.byID[rl.parent]; ok && rl.parent != 0 {
+		root.replies++
+		shown.lines[root.line] = root.format()
+		redraw(v)
+	}
+	if tv, err := g.View("thread"); err == nil && rl.parent != 0 && rl.parent == shown.thread {
+		fmt.Fprintf(tv, "\n%s %s: %s\n", rl.time, rl.sender, rl.body)
+	}
+	return rl.mention
+}
+
+// formatSearch turns a page of search results into lines for the view, each
+// hit is shown between the messages around it
+func formatSearch(body string) string {
+	var result mirc.SearchResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		return "invalid search reply\n"
+	}
+	if result.Total == 0 {
+		return fmt.Sprintf("\nNo messages found for %q\n", result.Query)
+	}
+	out := fmt.Sprintf("\nSearch %q: %d messages, page %d of %d\n", result.Query, result.Total, result.Page, result.Pages)
+	for _, hit := range result.Hits {
+		m := hit.Message
+		out += fmt.Sprintf("--- [%s] %s\n", m.Room, m.Time.Local().Format("Jan 2 15:04"))
+		for _, b := range hit.Before {
+			out += fmt.Sprintf("    %s: %s\n", b.Sender, b.Body)
+		}
+		out += fmt.Sprintf("  > %s: %s (id %d)\n", m.Sender, m.Body, m.ID)
+		for _, a := range hit.After {
+			out += fmt.Sprintf("    %s: %s\n", a.Sender, a.Body)
+		}
+	}
+	if result.Page < result.Pages {
+		out += fmt.Sprintf("more results: add page:%d to the search\n", result.Page+1)
+	}
+	return out
+}
+
+// formatRooms turns a page of the room list into a table for the view
+func formatRooms(body string) string {
+	var list mirc.RoomList
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		return "invalid room list\n"
+	}
+	if list.Total == 0 {
+		return "\nNo rooms found\n"
+	}
+	out := fmt.Sprintf("\nRooms: %d, page %d of %d\n", list.Total, list.Page, list.Pages)
+	out += fmt.Sprintf("  %-16s %7s %5s %-12s %s\n", "NAME", "MEMBERS", "MODES", "CREATED", "TOPIC")
+	for _, r := range list.Rooms {
+		modes := ""
+		if r.Modes != "" {
+			modes = "+" + r.Modes
+		}
+		out += fmt.Sprintf("  %-16s %7d %5s %-12s %s\n", r.Name, r.MemberCount, modes, r.Created.Local().Format("Jan 2 15:04"), r.Topic)
+	}
+	if list.Page < list.Pages {
+		out += fmt.Sprintf("more rooms: add page:%d to the list\n", list.Page+1)
+	}
+	return out
+}
+
+// formatMentions turns the mentions inbox sent by the server into lines for
+// the view
+func formatMentions(body string) string {
+	var inbox []mirc.HistoryMessage
+	if err := json.Unmarshal([]byte(body), &inbox); err != nil {
+		return "invalid mentions reply\n"
+	}
+	if len(inbox) == 0 {
+		return "\nNo mentions\n"
+	}
+	out := "\nMentions:\n"
+	for _, m := range inbox {
+		out += fmt.Sprintf("  %s [%s] %s: %s\n", m.Time.Local().Format("Jan 2 15:04"), m.Room, m.Sender, m.Body)
+	}
+	return out
+}
+
+// amendRoomMsg changes a shown room message after it was edited or deleted
+// and draws the view again
+func amendRoomMsg(v *gocui.View, msg *mirc.Message) {
+	rl, ok := shown.byID[msg.Header.ID]
+	if !ok {
+		// sent before we connected
+		return
+	}
+	if msg.Header.OpCode == mirc.SERVER_MESSAGE_DELETED {
+		rl.deleted = true
+	} else {
+		rl.body = msg.Body
+		rl.edited = true
+	}
+	shown.lines[rl.line] = rl.format()
+	redraw(v)
+}
+
+// openThread shows a thread fetched from the server in a pane on the right
+// half of the screen, the view is narrowed to make room for it
+func openThread(g *gocui.Gui, body string) error {
+	var thread []mirc.HistoryMessage
+	if err := json.Unmarshal([]byte(body), &thread); err != nil || len(thread) == 0 {
+		return errors.New("invalid thread")
+	}
+	maxX, maxY := g.Size()
+	if _, err := g.SetView("view", 2, 1, maxX/2-1, maxY-8); err != nil {
+		return err
+	}
+	tv, err := g.SetView("thread", maxX/2, 1, maxX-2, maxY-8)
+	if err != nil && err != gocui.ErrUnknownView {
+		return err
+	}
+	tv.Clear()
+	tv.Autoscroll = true
+	tv.Wrap = true
+	tv.Title = "thread in " + thread[0].Room
+	shown.thread = thread[0].ID
+	for _, m := range thread {
+		text := m.Body
+		if m.Deleted {
+			text = "(message deleted)"
+		} else if m.Edited {
+			text += " (edited)"
+		}
+		fmt.Fprintf(tv, "\n%s %s: %s\n", m.Time.Format("15:04"), m.Sender, text)
+	}
+	return nil
+}
+
+// closeThread removes the thread pane and widens the view again
+func closeThread(g *gocui.Gui) error {
+	shown.thread = 0
+	if err := g.DeleteView("thread"); err != nil {
+		return err
+	}
+	maxX, maxY := g.Size()
+	_, err := g.SetView("view", 2, 1, maxX-2, maxY-8)
+	return err
+}
+
+// lookupRef returns the message a number shown in the view stands for
+func lookupRef(ref string) (msgRef, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+	if err != nil || n < 1 || n > len(shown.refs) {
+		return msgRef{}, errors.New("no message #" + strings.TrimPrefix(ref, "#"))
+	}
+	return shown.refs[n-1], nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jroimartin/gocui"
+	"github.com/shaynewang/mirc"
+)
+
+// While the input view is edited the client tells the current room, or the
+// nick of a private message being written, that the user is typing. Who is
+// typing is shown in a status line above the input view.
+
+// Typing parameters
+const typingInterval = 3
+const typingShown = 5
+
+/******************** types ********************/
+// typer is someone typing in a room, or to us when room is empty
+type typer struct {
+	nick string
+	room string
+}
+
+/********************* Globals ******************/
+
+// don't send or show typing notifications
+var hideTyping bool
+
+// time our last typing notification was sent
+var lastTyping time.Time
+
+// who is typing and until when it's shown, only touched from the gui goroutine
+var typers = map[typer]time.Time{}
+
+/*********** Typing functions ************/
+// typingEditor edits the input view and lets the server know we are typing
+func (c *client) typingEditor(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) {
+	gocui.DefaultEditor.Edit(v, key, ch, mod)
+	if key == gocui.KeyEnter || hideTyping || time.Since(lastTyping) < typingInterval*time.Second {
+		return
+	}
+	receiver := typingReceiver(v.Buffer(), c.Room)
+	if receiver == "" {
+		return
+	}
+	lastTyping = time.Now()
+	c.socket().SendMsg(c.newMsg(mirc.CLIENT_TYPING, receiver, ""))
+}
+
+// typingReceiver returns who the line being written goes to, empty for
+// commands
+func typingReceiver(line string, room string) string {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '\\' {
+		return ""
+	}
+	if line[0] == '@' {
+		cmd, _ := comParser(line)
+		return cmd[1:]
+	}
+	return room
+}
+
+// typerOf returns who a typing notification is from, private ones have our
+// nick as receiver
+func (c *client) typerOf(msg *mirc.Message) typer {
+	t := typer{nick: msg.Header.Sender, room: msg.Header.Receiver}
+	if strings.EqualFold(t.room, c.nick()) {
+		t.room = ""
+	}
+	return t
+}
+
+// showTyping adds someone to the status line for a few seconds
+func (c *client) showTyping(g *gocui.Gui, msg *mirc.Message) {
+	t := c.typerOf(msg)
+	typers[t] = time.Now().Add(typingShown * time.Second)
+	time.AfterFunc(typingShown*time.Second, func() {
+		g.Execute(func(g *gocui.Gui) error {
+			c.drawStatus(g)
+			return nil
+		})
+	})
+	c.drawStatus(g)
+}
+
+// stopTyping takes someone off the status line once their message arrived
+func (c *client) stopTyping(g *gocui.Gui, msg *mirc.Message) {
+	t := c.typerOf(msg)
+	if _, ok := typers[t]; ok {
+		delete(typers, t)
+		c.drawStatus(g)
+	}
+}
+
+// drawStatus shows who is typing in the current room or to us
+func (c *client) drawStatus(g *gocui.Gui) {
+	sv, err := g.View("status")
+	if err != nil {
+		return
+	}
+	var names []string
+	now := time.Now()
+	for t, until := range typers {
+		if now.After(until) {
+			delete(typers, t)
+		} else if t.room == "" {
+			names = append(names, t.nick+" (private)")
+		} else if strings.EqualFold(t.room, c.Room) {
+			names = append(names, t.nick)
+		}
+	}
+	sort.Strings(names)
+	sv.Clear()
+	if len(names) == 1 {
+		sv.Write([]byte(names[0] + " is typing..."))
+	} else if len(names) > 1 {
+		sv.Write([]byte(strings.Join(names, ", ") + " are typing..."))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+	"github.com/shaynewang/mirc"
+)
+
+// The server keeps a read marker per room that all devices of a nick share.
+// Rooms with unread messages are listed with their count in the title of the
+// view, changing to such a room jumps to its first unread message.
+
+/********************* Globals ******************/
+
+// read markers by room, only touched from the gui goroutine
+var readMarkers = map[string]*mirc.ReadMarker{}
+
+/*********** Unread functions ************/
+// markRead tells the server we have read a room up to id, 0 marks
+// everything read
+func (c *client) markRead(room string, id int64) error {
+	msg := c.newMsg(mirc.CLIENT_MARK_READ, room, strconv.FormatInt(id, 10))
+	return c.socket().SendMsg(msg)
+}
+
+// updateMarker applies a read marker sent by the server
+func (c *client) updateMarker(g *gocui.Gui, body string) {
+	marker := new(mirc.ReadMarker)
+	if err := json.Unmarshal([]byte(body), marker); err != nil {
+		return
+	}
+	readMarkers[strings.ToLower(marker.Room)] = marker
+	if strings.EqualFold(marker.Room, c.Room) {
+		c.jumpToUnread(g)
+	}
+	c.drawTitle(g)
+}
+
+// countUnread counts a room message that arrived, one in the current room
+// is read right away
+func (c *client) countUnread(g *gocui.Gui, msg *mirc.Message) {
+	if msg.Header.ID == 0 || msg.Header.Sender == c.nick() || msg.Header.Sender == "server" {
+		return
+	}
+	if strings.EqualFold(msg.Header.Receiver, c.Room) {
+		c.markRead(msg.Header.Receiver, msg.Header.ID)
+		return
+	}
+	marker, ok := readMarkers[strings.ToLower(msg.Header.Receiver)]
+	if !ok {
+		marker = &mirc.ReadMarker{Room: msg.Header.Receiver}
+		readMarkers[strings.ToLower(msg.Header.Receiver)] = marker
+	}
+	if marker.Unread == 0 {
+		marker.FirstUnread = msg.Header.ID
+	}
+	marker.Unread++
+	c.drawTitle(g)
+}
+
+// jumpToUnread scrolls the view to the first unread message of the current
+// room if it is shown and marks the room read
+func (c *client) jumpToUnread(g *gocui.Gui) {
+	marker, ok := readMarkers[strings.ToLower(c.Room)]
+	if !ok || marker.Unread == 0 {
+		return
+	}
+	if rl, ok := shown.byID[marker.FirstUnread]; ok {
+		if v, err := g.View("view"); err == nil {
+			v.Autoscroll = false
+			v.SetOrigin(0, rowOf(v, rl.line))
+		}
+	}
+	c.markRead(c.Room, 0)
+}
+
+// rowOf returns the row of the view a transcript line starts on, long lines
+// wrap over several rows
+func rowOf(v *gocui.View, line int) int {
+	width, _ := v.Size()
+	if width < 1 {
+		width = 1
+	}
+	text := strings.Join(shown.lines[:line], "")
+	// colors take no room on the screen
+	text = strings.NewReplacer(highlight, "", resetColor, "").Replace(text)
+	rows := strings.Split(text, "\n")
+	y := 0
+	for _, row := range rows[:len(rows)-1] {
+		y += (utf8.RuneCountInString(row) + width - 1) / width
+		if row == "" {
+			y++
+		}
+	}
+	// room messages start with an empty row
+	return y + 1
+}
+
+// drawTitle shows the current room and the unread counts of the others
+func (c *client) drawTitle(g *gocui.Gui) {
+	v, err := g.View("view")
+	if err != nil {
+		return
+	}
+	var counts []string
+	for _, marker := range readMarkers {
+		if marker.Unread > 0 && !strings.EqualFold(marker.Room, c.Room) {
+			counts = append(counts, fmt.Sprintf("%s (%d)", marker.Room, marker.Unread))
+		}
+	}
+	sort.Strings(counts)
+	v.Title = c.Room
+	if len(counts) > 0 {
+		v.Title += " | unread: " + strings.Join(counts, ", ")
+	}
+}
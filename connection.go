@@ -1,9 +1,15 @@
 package mirc
 
-import "encoding/gob"
+import (
+	"bufio"
+	"encoding/gob"
+)
 
 // SendMsg passes a message object to a reciever client
+// writes are serialized so concurrent senders can share a connection
 func (c *Connection) SendMsg(msg *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	c.SetWriteDeadline(CalDeadline(10))
 	encoder := gob.NewEncoder(c)
 	err := encoder.Encode(&msg)
@@ -12,8 +18,13 @@ func (c *Connection) SendMsg(msg *Message) error {
 
 // GetMsg returns opCode, message if a message is in queue
 func (c *Connection) GetMsg() (int16, *Message) {
+	// keep one buffered reader per connection, a decoder on the bare
+	// connection would buffer and lose the start of the next message
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
+	}
 	recvMsg := new(Message)
-	decoder := gob.NewDecoder(c)
+	decoder := gob.NewDecoder(c.reader)
 	err := decoder.Decode(&recvMsg)
 	if err != nil {
 		return ERROR, nil
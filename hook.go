@@ -0,0 +1,93 @@
+package mirc
+
+import "sync"
+
+// HookResult tells the server what to do with a message once a hook saw it
+type HookResult int
+
+// Possible hook results
+const (
+	// HookContinue delivers the message, including changes the hook made
+	HookContinue HookResult = iota
+	// HookDrop discards the message, later hooks are not called
+	HookDrop
+)
+
+// Replier lets a hook send messages as the server. Replies are sent after
+// the message that triggered them has been delivered.
+type Replier interface {
+	// Tell sends a private server message to a nick
+	Tell(nick string, body string)
+	// Say sends a message to every member of a room as sender
+	Say(room string, sender string, body string)
+}
+
+// Hook is notified of client events on the server. Hooks are called in
+// registration order, mostly from the goroutine serving the client, so they
+// must not block for long. Embed NopHook to implement only the events you need.
+type Hook interface {
+	// OnConnect is called once a client has registered its nick, returning
+	// an error disconnects the client with the error as reason
+	OnConnect(c *Client) error
+	// OnDisconnect is called after a client has left the server
+	OnDisconnect(c *Client)
+	// OnJoin is called before a client joins or creates a room, returning an
+	// error refuses the join
+	OnJoin(c *Client, room string) error
+	// OnLeave is called after a client has left a room, also when it quits,
+	// is lost in a netsplit or the room is deleted
+	OnLeave(c *Client, room string)
+	// OnMessage is called before a room or private message from c is
+	// delivered. The hook may change m in place or drop it.
+	OnMessage(c *Client, m *Message, reply Replier) HookResult
+}
+
+// NopHook implements Hook without doing anything
+type NopHook struct{}
+
+// OnConnect implements Hook
+func (NopHook) OnConnect(c *Client) error { return nil }
+
+// OnDisconnect implements Hook
+func (NopHook) OnDisconnect(c *Client) {}
+
+// OnJoin implements Hook
+func (NopHook) OnJoin(c *Client, room string) error { return nil }
+
+// OnLeave implements Hook
+func (NopHook) OnLeave(c *Client, room string) {}
+
+// OnMessage implements Hook
+func (NopHook) OnMessage(c *Client, m *Message, reply Replier) HookResult { return HookContinue }
+
+var hooks = struct {
+	mu   sync.Mutex
+	list []Hook
+}{}
+
+// RegisterHook adds a hook to the server, usually from a plugin package's init
+func RegisterHook(h Hook) {
+	hooks.mu.Lock()
+	hooks.list = append(hooks.list, h)
+	hooks.mu.Unlock()
+}
+
+// UnregisterHook removes a hook added with RegisterHook, h must be the same
+// value, hooks holding maps or slices should be registered as pointers
+func UnregisterHook(h Hook) {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	for i, registered := range hooks.list {
+		if registered == h {
+			hooks.list = append(hooks.list[:i:i], hooks.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// Hooks returns the registered hooks in registration order
+func Hooks() []Hook {
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+	return append([]Hook(nil), hooks.list...)
+}
@@ -0,0 +1,41 @@
+package mirc
+
+import (
+	"strings"
+	"testing"
+)
+
+type upperHook struct {
+	NopHook
+}
+
+func (upperHook) OnMessage(c *Client, m *Message, reply Replier) HookResult {
+	m.Body = strings.ToUpper(m.Body)
+	return HookContinue
+}
+
+func TestRegisterHook(t *testing.T) {
+	before := len(Hooks())
+	RegisterHook(NopHook{})
+	RegisterHook(upperHook{})
+	t.Cleanup(func() {
+		UnregisterHook(NopHook{})
+		UnregisterHook(upperHook{})
+		if len(Hooks()) != before {
+			t.Error("hooks still registered")
+		}
+	})
+	list := Hooks()
+	if len(list) != before+2 {
+		t.Fatalf("expected %d hooks, got %d", before+2, len(list))
+	}
+	m := NewMsg(CLIENT_SEND_PUB_MESSAGE, "public", "hello")
+	for _, h := range list[before:] {
+		if h.OnMessage(&Client{Nick: "fakeNick"}, m, nil) != HookContinue {
+			t.Error("hook dropped the message")
+		}
+	}
+	if m.Body != "HELLO" {
+		t.Errorf("hook change was lost, body is %q", m.Body)
+	}
+}
@@ -0,0 +1,38 @@
+package mirc
+
+import "strings"
+
+// Mentions returns the nicks a message mentions, either as "@nick" anywhere
+// in the text or as "nick:" at its start. Each nick is listed once
+func Mentions(body string) []string {
+	var nicks []string
+	for i, word := range strings.Fields(body) {
+		var nick string
+		if strings.HasPrefix(word, "@") {
+			nick = strings.TrimRight(word[1:], ".,:;!?)'\"")
+		} else if i == 0 && strings.HasSuffix(word, ":") {
+			nick = strings.TrimSuffix(word, ":")
+		}
+		if ValidateNick(nick) != nil {
+			continue
+		}
+		seen := false
+		for _, n := range nicks {
+			seen = seen || CanonicalName(n) == CanonicalName(nick)
+		}
+		if !seen {
+			nicks = append(nicks, nick)
+		}
+	}
+	return nicks
+}
+
+// Mentioned reports whether a message mentions nick
+func Mentioned(body string, nick string) bool {
+	for _, n := range Mentions(body) {
+		if CanonicalName(n) == CanonicalName(nick) {
+			return true
+		}
+	}
+	return false
+}
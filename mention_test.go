@@ -0,0 +1,30 @@
+package mirc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	var tests = []struct {
+		body  string
+		nicks []string
+	}{
+		{"hello world", nil},
+		{"@alice look at this", []string{"alice"}},
+		{"thanks @Bob, and @carol!", []string{"Bob", "carol"}},
+		{"alice: are you there?", []string{"alice"}},
+		{"ping me later: alice", nil},
+		{"@alice @ALICE alice", []string{"alice"}},
+		{"mail me at bob@example.com", nil},
+		{"@2fast @ @server", nil},
+	}
+	for _, test := range tests {
+		if got := Mentions(test.body); !reflect.DeepEqual(got, test.nicks) {
+			t.Errorf("Mentions(%q) = %v, expected %v", test.body, got, test.nicks)
+		}
+	}
+	if !Mentioned("hey @Alice", "alice") || Mentioned("hey alice", "alice") {
+		t.Error("Mentioned does not match Mentions")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// A nick registered with a password can log in from several devices at once,
+// each connection gets the messages of the nick. Unregistered nicks connect
+// as guests with a single connection.
+
+const accountFile = "accounts.json"
+
+// Password parameters
+const minPasswordLen = 6
+const passwordRounds = 10000
+
+/******************** types ********************/
+type account struct {
+	Nick    string    `json:"nick"`
+	Salt    string    `json:"salt"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+type accountList struct {
+	mu   sync.Mutex
+	list map[string]account
+}
+
+/********************* Globals ******************/
+
+// registered nicks
+var accounts = accountList{
+	mu:   sync.Mutex{},
+	list: map[string]account{},
+}
+
+/********************** Account funtions *****************/
+// hashPassword derives the stored hash of a password with PBKDF2-HMAC-SHA256
+func hashPassword(password string, salt []byte) string {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < passwordRounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return hex.EncodeToString(key)
+}
+
+// register adds an account for a nick and persists the list
+func (l *accountList) register(nick string, password string) error {
+	if len(password) < minPasswordLen {
+		return errors.New("password must be at least 6 characters")
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.list[fold(nick)]; ok {
+		return errors.New("nickname " + nick + " is already registered")
+	}
+	l.list[fold(nick)] = account{
+		Nick:    nick,
+		Salt:    hex.EncodeToString(salt),
+		Hash:    hashPassword(password, salt),
+		Created: time.Now(),
+	}
+	return l.save()
+}
+
+// registered reports whether a nick belongs to an account
+func (l *accountList) registered(nick string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.list[fold(nick)]
+	return ok
+}
+
+// check reports whether the password matches the account of a nick
+func (l *accountList) check(nick string, password string) bool {
+	l.mu.Lock()
+	a, ok := l.list[fold(nick)]
+	l.mu.Unlock()
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(a.Salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashPassword(password, salt)), []byte(a.Hash)) == 1
+}
+
+// save persists the accounts, assumes lock is held
+func (l *accountList) save() error {
+	list := make([]account, 0, len(l.list))
+	for _, a := range l.list {
+		list = append(list, a)
+	}
+	return saveState(accountFile, list)
+}
+
+// load reads the persisted accounts
+func (l *accountList) load() error {
+	var list []account
+	if err := loadState(accountFile, &list); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, a := range list {
+		l.list[fold(a.Nick)] = a
+	}
+	return nil
+}
+
+// addGuest adds a client connecting without a password, registered nicks
+// have to log in
+func addGuest(nick string, conn *mirc.Connection) (*client, error) {
+	if accounts.registered(nick) {
+		return nil, errors.New("nickname is registered, log in with its password")
+	}
+	return addClient(nick, conn, &clients)
+}
+
+// attachDevice adds another connection to a connected local nick
+func attachDevice(nick string, conn *mirc.Connection) (*client, error) {
+	clients.mu.Lock()
+	cl, ok := clients.list[fold(nick)]
+	clients.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no such nick " + nick)
+	}
+	if cl.Server != "" {
+		return nil, errors.New(cl.Nick + " is connected to " + cl.Server)
+	}
+	// the reply goes out before the connection is attached so it is the
+	// first message the client reads
+	if err := conn.SendMsg(newMsg(mirc.CONNECTION_SUCCESS, cl.Nick, "Connection established")); err != nil {
+		return nil, err
+	}
+	clients.mu.Lock()
+	sessions.mu.Lock()
+	cl, ok = clients.list[fold(nick)]
+	if !ok || cl.Server != "" {
+		sessions.mu.Unlock()
+		clients.mu.Unlock()
+		return nil, errors.New(nick + " has left")
+	}
+	loop, missed := attach(cl, conn)
+	token := ""
+	if s, ok := sessions.byNick[fold(loop.Nick)]; ok {
+		token = s.token
+	}
+	sessions.mu.Unlock()
+	clients.mu.Unlock()
+	if token != "" {
+		loop.send(newMsg(mirc.SERVER_RESUME_TOKEN, loop.Nick, token))
+	}
+	for _, m := range missed {
+		loop.send(m)
+	}
+	return loop, nil
+}
+
+// loginConnection serves a connection that logs in to a registered nick,
+// the message body holds "nick password"
+func loginConnection(con *mirc.Connection, m *mirc.Message) {
+	args := strings.SplitN(m.Body, " ", 2)
+	if len(args) != 2 || !accounts.check(args[0], args[1]) {
+		con.SendMsg(newMsg(mirc.CONNECTION_CLOSED, "", "invalid nickname or password"))
+		// a body without a valid nick may be just the password
+		if len(args) == 2 && mirc.ValidateNick(args[0]) == nil {
+			logWarn("failed login", "nick", args[0], "remote", con.RemoteAddr())
+		} else {
+			logWarn("failed login", "remote", con.RemoteAddr())
+		}
+		return
+	}
+	client, err := addClient(args[0], con, &clients)
+	if err == nil {
+		client.welcome()
+	} else if client, err = attachDevice(args[0], con); err == nil {
+		client.sendMarkers()
+		logInfo("device connected", "nick", client.Nick, "remote", con.RemoteAddr())
+	} else {
+		con.SendMsg(newMsg(mirc.CONNECTION_CLOSED, "", err.Error()))
+		logInfo("login refused", "nick", args[0], "remote", con.RemoteAddr(), "err", err)
+		return
+	}
+	client.requestHandler()
+}
+
+// registerHandler registers the nick of the client with the password in the body
+func (c *client) registerHandler(m *mirc.Message) {
+	if err := accounts.register(c.Nick, m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "nickname "+c.Nick+" registered, log in with its password from any device"))
+	logInfo("nick registered", "nick", c.Nick, "remote", c.IP)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestAccounts(t *testing.T) {
+	config.DataDir = ""
+	l := accountList{list: map[string]account{}}
+	if err := l.register("alice", "short"); err == nil {
+		t.Error("registered with a short password")
+	}
+	if err := l.register("Alice", "secret1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.register("ALICE", "secret2"); err == nil {
+		t.Error("registered the same nick twice")
+	}
+	if !l.registered("alice") {
+		t.Error("registered nick not found")
+	}
+	if !l.check("alice", "secret1") {
+		t.Error("right password refused")
+	}
+	if l.check("alice", "secret2") || l.check("bob", "secret1") {
+		t.Error("wrong login accepted")
+	}
+	if l.list["alice"].Hash == "secret1" {
+		t.Error("password stored in clear")
+	}
+}
+
+func TestAttachDevice(t *testing.T) {
+	savedClients := clients.list
+	defer func() { clients.list = savedClients }()
+	phone, _ := testClient("alice", "10.0.0.1:5000")
+	clients.list = map[string]client{"alice": phone, "bob": {Nick: "bob", Server: "beta"}}
+	laptop, laptopMsgs := testClient("alice", "10.0.0.2:5000")
+	if _, err := attachDevice("bob", laptop.Socket); err == nil {
+		t.Error("attached to a nick of a linked server")
+	}
+	loop, err := attachDevice("ALICE", laptop.Socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := <-laptopMsgs; m.Header.OpCode != mirc.CONNECTION_SUCCESS {
+		t.Errorf("expected the connection reply first, got %+v", m)
+	}
+	if loop.Socket != laptop.Socket || len(clients.list["alice"].Devices) != 2 {
+		t.Error("device not attached")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+/********************** API funtions *****************/
+// roomInfo describes a room, assumes rooms lock is held
+func roomInfo(r room, withMembers bool) mirc.RoomInfo {
+	info := mirc.RoomInfo{
+		Name:        r.Name,
+		MemberCount: len(r.Members),
+		Topic:       r.Topic,
+		Modes:       r.Modes,
+		Created:     r.Created,
+	}
+	if withMembers {
+		info.Members = append([]string{}, r.Members...)
+	}
+	return info
+}
+
+// clientInfo describes a client, assumes rooms lock is held
+func clientInfo(c client) mirc.ClientInfo {
+	info := mirc.ClientInfo{
+		Nick:        c.Nick,
+		Server:      c.Server,
+		Rooms:       roomsOf(c.Nick),
+		Connected:   c.Connected,
+		IdleSeconds: int(time.Since(c.LastActive).Seconds()),
+		Away:        c.Away,
+	}
+	if c.IP != nil {
+		info.IP = remoteIP(c.IP).String()
+	}
+	return info
+}
+
+// writeJSON replies with v encoded as json
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError replies with a json error object
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// apiAuth only lets GET requests with the configured bearer token through
+func apiAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if apiToken := currentConfig().APIToken; apiToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// healthHandler reports that the server is up
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// roomsHandler lists all rooms but secret ones sorted by name
+func roomsHandler(w http.ResponseWriter, r *http.Request) {
+	infos := []mirc.RoomInfo{}
+	rooms.mu.Lock()
+	for _, rm := range rooms.list {
+		if !rm.hasMode('s') {
+			infos = append(infos, roomInfo(rm, false))
+		}
+	}
+	rooms.unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// roomHandler describes one room including its members, secret rooms are
+// not found
+func roomHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/rooms/")
+	rooms.mu.Lock()
+	rm, ok := rooms.list[fold(name)]
+	ok = ok && !rm.hasMode('s')
+	var info mirc.RoomInfo
+	if ok {
+		info = roomInfo(rm, true)
+	}
+	rooms.unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "room "+name+" doesn't exist")
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// clientsHandler lists all connected clients sorted by nick, without their
+// secret rooms
+func clientsHandler(w http.ResponseWriter, r *http.Request) {
+	clients.mu.Lock()
+	list := make([]client, 0, len(clients.list))
+	for _, cl := range clients.list {
+		list = append(list, cl)
+	}
+	clients.mu.Unlock()
+	infos := make([]mirc.ClientInfo, 0, len(list))
+	rooms.mu.Lock()
+	for _, cl := range list {
+		info := clientInfo(cl)
+		public := []string{}
+		for _, name := range info.Rooms {
+			if rm := rooms.list[fold(name)]; !rm.hasMode('s') {
+				public = append(public, name)
+			}
+		}
+		info.Rooms = public
+		infos = append(infos, info)
+	}
+	rooms.unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Nick < infos[j].Nick })
+	writeJSON(w, http.StatusOK, infos)
+}
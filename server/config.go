@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// operConf holds the credentials of one server operator
+type operConf struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+}
+
+// linkConf describes a linked server, addr is dialed when it's set
+// otherwise the link is only accepted from the other side
+type linkConf struct {
+	Name     string `yaml:"name"`
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+}
+
+// webhookConf describes an outgoing webhook for the messages of a room
+type webhookConf struct {
+	Room    string `yaml:"room"`
+	URL     string `yaml:"url"`
+	Secret  string `yaml:"secret"`
+	Timeout int    `yaml:"timeout"`
+	Retries int    `yaml:"retries"`
+}
+
+// scheduleConf describes a message sent to a room, or to everyone when room
+// is "*", on a schedule like "daily 09:55" or "every 2h"
+type scheduleConf struct {
+	Room   string `yaml:"room"`
+	When   string `yaml:"when"`
+	Body   string `yaml:"body"`
+	Sender string `yaml:"sender"`
+}
+
+// serverConf holds the settings read from the server configuration file
+type serverConf struct {
+	Listen              string         `yaml:"listen"`
+	MaxConnections      int            `yaml:"maxConnections"`
+	MaxConnectionsPerIP int            `yaml:"maxConnectionsPerIP"`
+	DataDir             string         `yaml:"dataDir"`
+	Opers               []operConf     `yaml:"opers"`
+	HTTPListen          string         `yaml:"httpListen"`
+	APIToken            string         `yaml:"apiToken"`
+	LogLevel            string         `yaml:"logLevel"`
+	LogFormat           string         `yaml:"logFormat"`
+	ServerName          string         `yaml:"serverName"`
+	Links               []linkConf     `yaml:"links"`
+	Webhooks            []webhookConf  `yaml:"webhooks"`
+	AutoAway            int            `yaml:"autoAway"`
+	ResumeGrace         int            `yaml:"resumeGrace"`
+	HistorySize         int            `yaml:"historySize"`
+	Schedules           []scheduleConf `yaml:"schedules"`
+	PermanentRooms      []string       `yaml:"permanentRooms"`
+	AutoJoin            []string       `yaml:"autoJoin"`
+}
+
+// defaultConf returns the settings used for keys missing from the file
+func defaultConf() serverConf {
+	return serverConf{
+		Listen:      listenPort,
+		DataDir:     "data",
+		LogLevel:    "info",
+		LogFormat:   "logfmt",
+		ServerName:  "mirc",
+		HistorySize: 1000,
+	}
+}
+
+// server configuration, it is only written directly before the server
+// starts, afterwards use currentConfig and setConfig
+var config = defaultConf()
+var configMu sync.RWMutex
+
+// currentConfig returns the configuration in effect
+func currentConfig() serverConf {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// setConfig replaces the configuration in effect
+func setConfig(c serverConf) {
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+}
+
+// getConf reads the configuration file into config
+// a missing file is not an error, the defaults are used instead
+func getConf(path string, config *serverConf) error {
+	configFile, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		logWarn("configuration file not found, using defaults", "path", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(configFile, config)
+}
+
+// loadConf reads the configuration file on top of the defaults, so keys
+// removed from the file don't keep their old values
+func loadConf(path string) (serverConf, error) {
+	c := defaultConf()
+	err := getConf(path, &c)
+	return c, err
+}
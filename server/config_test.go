@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "server.yaml")
+	write := func(text string) serverConf {
+		if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConf(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c := write("maxConnections: 5\nopers:\n  - name: admin\n    password: pw\n")
+	if c.MaxConnections != 5 || len(c.Opers) != 1 || c.HistorySize != 1000 {
+		t.Errorf("unexpected configuration %+v", c)
+	}
+	c = write("maxConnections: 5\n")
+	if len(c.Opers) != 0 {
+		t.Errorf("removed operator is still configured: %+v", c.Opers)
+	}
+	if c, err := loadConf(filepath.Join(dir, "missing.yaml")); err != nil || c.ServerName != "mirc" {
+		t.Errorf("missing file doesn't give the defaults: %+v %v", c, err)
+	}
+}
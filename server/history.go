@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Every room keeps its latest messages so they can be edited, deleted and
+// looked up again. History lives in memory and goes away with the room.
+// Replies point at the first message of their thread.
+
+/******************** types ********************/
+type historyEntry mirc.HistoryMessage
+type historyList struct {
+	mu    sync.Mutex
+	rooms map[string][]*historyEntry
+	// search index of every room
+	index map[string]wordIndex
+}
+
+/********************* Globals ******************/
+
+// recent messages by room
+var history = historyList{
+	mu:    sync.Mutex{},
+	rooms: map[string][]*historyEntry{},
+}
+
+/********************** History funtions *****************/
+// record applies a message delivered to a room to its history, author is who
+// may change a new message as returned by authorOf
+func (h *historyList) record(m *mirc.Message, author string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := fold(m.Header.Receiver)
+	if m.Header.OpCode == mirc.SERVER_BROADCAST_MESSAGE {
+		e := &historyEntry{
+			ID:     m.Header.ID,
+			Room:   m.Header.Receiver,
+			Sender: m.Header.Sender,
+			Body:   m.Body,
+			Time:   m.Header.Time,
+			Parent: m.Header.Parent,
+			Author: author,
+		}
+		list := append(h.rooms[key], e)
+		h.indexEntry(key, e)
+		if m.Header.Parent != 0 {
+			if root := h.lookup(key, m.Header.Parent); root != nil {
+				root.Replies++
+			}
+		}
+		if size := currentConfig().HistorySize; size > 0 && len(list) > size {
+			for _, old := range list[:len(list)-size] {
+				h.unindexEntry(key, old)
+			}
+			list = list[len(list)-size:]
+		}
+		h.rooms[key] = list
+		return
+	}
+	e := h.lookup(key, m.Header.ID)
+	if e == nil || e.Deleted {
+		return
+	}
+	h.unindexEntry(key, e)
+	if m.Header.OpCode == mirc.SERVER_MESSAGE_EDITED {
+		e.Body = m.Body
+		e.Edited = true
+		h.indexEntry(key, e)
+	} else if m.Header.OpCode == mirc.SERVER_MESSAGE_DELETED {
+		e.Body = ""
+		e.Deleted = true
+		if e.Parent != 0 {
+			if root := h.lookup(key, e.Parent); root != nil && root.Replies > 0 {
+				root.Replies--
+			}
+		}
+	}
+}
+
+// lookup finds a message in a room, assumes lock is held
+func (h *historyList) lookup(key string, id int64) *historyEntry {
+	for _, e := range h.rooms[key] {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// find returns a copy of a message of a room
+func (h *historyList) find(roomName string, id int64) (historyEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.lookup(fold(roomName), id)
+	if e == nil {
+		return historyEntry{}, false
+	}
+	return *e, true
+}
+
+// latest returns the id of the newest message of a room, 0 if there is none
+func (h *historyList) latest(roomName string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	list := h.rooms[fold(roomName)]
+	if len(list) == 0 {
+		return 0
+	}
+	return list[len(list)-1].ID
+}
+
+// unread counts the messages of a room newer than lastRead that nick didn't
+// send and returns the id of the first of them, server notices don't count
+func (h *historyList) unread(roomName string, nick string, lastRead int64) (int, int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	count := 0
+	var first int64
+	for _, e := range h.rooms[fold(roomName)] {
+		if e.ID <= lastRead || e.Deleted || fold(e.Sender) == fold(nick) || e.Sender == "server" {
+			continue
+		}
+		if first == 0 {
+			first = e.ID
+		}
+		count++
+	}
+	return count, first
+}
+
+// thread returns the first message of a thread followed by its replies
+func (h *historyList) thread(roomName string, id int64) ([]mirc.HistoryMessage, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := fold(roomName)
+	root := h.lookup(key, id)
+	if root == nil {
+		return nil, errors.New("message not found")
+	}
+	if root.Parent != 0 {
+		if root = h.lookup(key, root.Parent); root == nil {
+			return nil, errors.New("message not found")
+		}
+	}
+	list := []mirc.HistoryMessage{mirc.HistoryMessage(*root)}
+	for _, e := range h.rooms[key] {
+		if e.Parent == root.ID {
+			list = append(list, mirc.HistoryMessage(*e))
+		}
+	}
+	return list, nil
+}
+
+// threadParent points a reply at the first message of its thread, replies
+// to replies join the same thread
+func threadParent(m *mirc.Message) error {
+	parent, ok := history.find(m.Header.Receiver, m.Header.Parent)
+	if !ok || parent.Deleted {
+		return errors.New("message not found")
+	}
+	if parent.Parent != 0 {
+		m.Header.Parent = parent.Parent
+	}
+	return nil
+}
+
+// threadHandler replies with a thread as json, the receiver field holds the
+// room and the body the id of a message in the thread
+func (c *client) threadHandler(m *mirc.Message) {
+	id, _, err := parseMsgRef(m.Body)
+	if err == nil && !c.inRoom(m.Header.Receiver) {
+		err = errors.New("not a member of the room")
+	}
+	var thread []mirc.HistoryMessage
+	if err == nil {
+		thread, err = history.thread(m.Header.Receiver, id)
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	body, err := json.Marshal(thread)
+	if err != nil {
+		logError("cannot encode thread", "room", m.Header.Receiver, "err", err)
+		return
+	}
+	c.send(newMsg(mirc.SERVER_RPL_THREAD, c.Nick, string(body)))
+}
+
+// drop forgets the history of a room
+func (h *historyList) drop(roomName string) {
+	h.mu.Lock()
+	delete(h.rooms, fold(roomName))
+	delete(h.index, fold(roomName))
+	h.mu.Unlock()
+}
+
+// parseMsgRef splits "id text" into the message id and the text
+func parseMsgRef(body string) (int64, string, error) {
+	args := strings.SplitN(body, " ", 2)
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return 0, "", errors.New("invalid message id " + args[0])
+	}
+	if len(args) < 2 {
+		return id, "", nil
+	}
+	return id, args[1], nil
+}
+
+// authorOf returns who is behind a local nick: the account of a registered
+// nick, which only its owner can log in to, or else the connection that took
+// the nick. Empty when the nick isn't a local client
+func authorOf(nick string) string {
+	clients.mu.Lock()
+	cl, ok := clients.list[fold(nick)]
+	clients.mu.Unlock()
+	if !ok || cl.Server != "" {
+		return ""
+	}
+	if accounts.registered(cl.Nick) {
+		return "account " + fold(cl.Nick)
+	}
+	return "connection " + strconv.FormatInt(cl.ConnID, 10)
+}
+
+// amendMessage checks that the client may change a message of a room and
+// broadcasts the change, assumes rooms lock is held
+func (c *client) amendMessage(opCode int16, roomName string, id int64, body string) error {
+	r, ok := rooms.list[fold(roomName)]
+	if !ok {
+		return errors.New("room " + roomName + " doesn't exist")
+	}
+	e, ok := history.find(r.Name, id)
+	if !ok || e.Deleted {
+		return errors.New("message not found")
+	}
+	sender := e.Author != "" && e.Author == authorOf(c.Nick)
+	if !sender && !c.Oper && containFold(r.Ops, c.Nick) < 0 {
+		return errors.New("permission denied: only the sender or a room operator can change this message")
+	}
+	msg := newMsg(opCode, r.Name, body)
+	msg.Header.Sender = e.Sender
+	msg.Header.ID = e.ID
+	msg.Header.Time = e.Time
+	deliverBroadcast(msg, "")
+	return nil
+}
+
+// editMessageHandler replaces the text of a room message, the receiver field
+// holds the room and the body "id text"
+func (c *client) editMessageHandler(m *mirc.Message) {
+	id, text, err := parseMsgRef(m.Body)
+	if err == nil && text == "" {
+		err = errors.New("please specify the new text")
+	}
+	if err == nil {
+		rooms.mu.Lock()
+		err = c.amendMessage(mirc.SERVER_MESSAGE_EDITED, m.Header.Receiver, id, text)
+		rooms.unlock()
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	logDebug("message edited", "nick", c.Nick, "room", m.Header.Receiver, "id", id)
+}
+
+// deleteMessageHandler retracts a room message, the receiver field holds the
+// room and the body the id
+func (c *client) deleteMessageHandler(m *mirc.Message) {
+	id, _, err := parseMsgRef(m.Body)
+	if err == nil {
+		rooms.mu.Lock()
+		err = c.amendMessage(mirc.SERVER_MESSAGE_DELETED, m.Header.Receiver, id, "")
+		rooms.unlock()
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	logInfo("message deleted", "nick", c.Nick, "room", m.Header.Receiver, "id", id)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestHistoryRecord(t *testing.T) {
+	config.HistorySize = 3
+	defer func() { config.HistorySize = 1000 }()
+	h := historyList{rooms: map[string][]*historyEntry{}}
+	for id := int64(1); id <= 5; id++ {
+		m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "Lobby", "hello")
+		m.Header.Sender = "alice"
+		m.Header.ID = id
+		h.record(m, "")
+	}
+	if n := len(h.rooms["lobby"]); n != 3 {
+		t.Fatalf("expected 3 messages kept, got %d", n)
+	}
+	if _, ok := h.find("lobby", 1); ok {
+		t.Error("oldest message was not dropped")
+	}
+	edit := mirc.NewMsg(mirc.SERVER_MESSAGE_EDITED, "LOBBY", "hello world")
+	edit.Header.ID = 4
+	h.record(edit, "")
+	if e, _ := h.find("lobby", 4); e.Body != "hello world" || !e.Edited {
+		t.Errorf("message not edited: %+v", e)
+	}
+	del := mirc.NewMsg(mirc.SERVER_MESSAGE_DELETED, "lobby", "")
+	del.Header.ID = 5
+	h.record(del, "")
+	if e, _ := h.find("lobby", 5); e.Body != "" || !e.Deleted {
+		t.Errorf("message not deleted: %+v", e)
+	}
+	h.drop("Lobby")
+	if _, ok := h.find("lobby", 4); ok {
+		t.Error("history of a dropped room is still there")
+	}
+}
+
+func TestHistoryThread(t *testing.T) {
+	h := historyList{rooms: map[string][]*historyEntry{}}
+	for id := int64(1); id <= 4; id++ {
+		m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "lobby", "hello")
+		m.Header.ID = id
+		if id > 2 {
+			m.Header.Parent = 1
+		}
+		h.record(m, "")
+	}
+	if e, _ := h.find("lobby", 1); e.Replies != 2 {
+		t.Errorf("expected 2 replies, got %d", e.Replies)
+	}
+	del := mirc.NewMsg(mirc.SERVER_MESSAGE_DELETED, "lobby", "")
+	del.Header.ID = 4
+	h.record(del, "")
+	h.record(del, "")
+	if e, _ := h.find("lobby", 1); e.Replies != 1 {
+		t.Errorf("expected 1 reply left after deleting one, got %d", e.Replies)
+	}
+	thread, err := h.thread("Lobby", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thread) != 3 || thread[0].ID != 1 || thread[1].ID != 3 || thread[2].ID != 4 {
+		t.Errorf("unexpected thread %+v", thread)
+	}
+	if _, err := h.thread("lobby", 9); err == nil {
+		t.Error("thread of an unknown message was found")
+	}
+}
+
+func TestAmendMessage(t *testing.T) {
+	savedConf, savedClients, savedRooms, savedHistory := config, clients.list, rooms.list, history.rooms
+	defer func() {
+		config, clients.list, rooms.list, history.rooms = savedConf, savedClients, savedRooms, savedHistory
+	}()
+	config.DataDir = ""
+	history.rooms = map[string][]*historyEntry{}
+	alice, _ := testClient("alice", "10.0.0.1:5000")
+	alice.ConnID = 1
+	clients.list = map[string]client{"alice": alice}
+	rooms.list = map[string]room{"lobby": {Name: "lobby", Members: []string{"server", "alice"}}}
+	m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "lobby", "hello")
+	m.Header.Sender = "alice"
+	m.Header.ID = 1
+	history.record(m, authorOf("alice"))
+
+	if err := renameClient("alice", "alicia"); err != nil {
+		t.Fatal(err)
+	}
+	alice.Nick = "alicia"
+	if err := alice.amendMessage(mirc.SERVER_MESSAGE_EDITED, "lobby", 1, "hello all"); err != nil {
+		t.Errorf("sender cannot edit after a nick change: %v", err)
+	}
+	removeClient("alicia", clients.list)
+	guest, _ := testClient("alice", "10.0.0.2:5000")
+	guest.ConnID = 2
+	clients.list["alice"] = guest
+	err := guest.amendMessage(mirc.SERVER_MESSAGE_DELETED, "lobby", 1, "")
+	if err == nil || !strings.HasPrefix(err.Error(), "permission denied") {
+		t.Errorf("a guest who took the sender's nick deleted the message: %v", err)
+	}
+}
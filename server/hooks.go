@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/shaynewang/mirc"
+)
+
+// Hooks are registered with mirc.RegisterHook, usually by plugin packages
+// imported for their side effects in server.go.
+
+/******************** types ********************/
+// hookReplier queues the replies of hooks until the message is delivered
+type hookReplier struct {
+	queue []func()
+}
+
+/********************** Hook funtions *****************/
+// Tell implements mirc.Replier
+func (r *hookReplier) Tell(nick string, body string) {
+	r.queue = append(r.queue, func() { tell(nick, body) })
+}
+
+// Say implements mirc.Replier
+func (r *hookReplier) Say(roomName string, sender string, body string) {
+	r.queue = append(r.queue, func() { sayInRoom(roomName, sender, body) })
+}
+
+// flush sends the queued replies
+func (r *hookReplier) flush() {
+	for _, f := range r.queue {
+		f()
+	}
+	r.queue = nil
+}
+
+// connectHooks runs OnConnect hooks, the first error refuses the client
+func (c *client) connectHooks() error {
+	for _, h := range mirc.Hooks() {
+		if err := h.OnConnect((*mirc.Client)(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disconnectHooks runs OnDisconnect hooks
+func (c *client) disconnectHooks() {
+	for _, h := range mirc.Hooks() {
+		h.OnDisconnect((*mirc.Client)(c))
+	}
+}
+
+// joinHooks runs OnJoin hooks, the first error refuses the join
+func (c *client) joinHooks(roomName string) error {
+	for _, h := range mirc.Hooks() {
+		if err := h.OnJoin((*mirc.Client)(c), roomName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaveHooks runs OnLeave hooks
+func (c *client) leaveHooks(roomName string) {
+	for _, h := range mirc.Hooks() {
+		h.OnLeave((*mirc.Client)(c), roomName)
+	}
+}
+
+// messageHooks runs OnMessage hooks and reports whether m should be delivered
+// replies are returned so they can be sent after the delivery
+func (c *client) messageHooks(m *mirc.Message) (bool, *hookReplier) {
+	reply := &hookReplier{}
+	for _, h := range mirc.Hooks() {
+		if h.OnMessage((*mirc.Client)(c), m, reply) == mirc.HookDrop {
+			return false, reply
+		}
+	}
+	return true, reply
+}
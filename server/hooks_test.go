@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+// leaveRecorder remembers the rooms clients left as "nick room"
+type leaveRecorder struct {
+	mirc.NopHook
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (h *leaveRecorder) OnLeave(c *mirc.Client, roomName string) {
+	h.mu.Lock()
+	h.seen[c.Nick+" "+roomName] = true
+	h.mu.Unlock()
+}
+
+func (h *leaveRecorder) left(nick string, roomName string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seen[nick+" "+roomName]
+}
+
+func TestLeaveHooks(t *testing.T) {
+	savedConf, savedClients, savedRooms := config, clients.list, rooms.list
+	defer func() { config, clients.list, rooms.list = savedConf, savedClients, savedRooms }()
+	config.DataDir = ""
+	hook := &leaveRecorder{seen: map[string]bool{}}
+	mirc.RegisterHook(hook)
+	t.Cleanup(func() { mirc.UnregisterHook(hook) })
+	alice, _ := testClient("alice", "10.0.0.1:5000")
+	alice.Oper = true
+	bob, _ := testClient("bob", "10.0.0.2:5000")
+	clients.list = map[string]client{
+		"alice": alice,
+		"bob":   bob,
+		"carol": {Nick: "carol", Server: "beta"},
+	}
+	rooms.list = map[string]room{
+		"public": {Name: "public", Members: []string{"server", "alice", "bob", "carol"}},
+		"team":   {Name: "Team", Members: []string{"alice", "bob"}},
+	}
+
+	alice.deleteRoomHandler(mirc.NewMsg(mirc.CLIENT_DELETE_ROOM, "", "team"))
+	if !hook.left("alice", "Team") || !hook.left("bob", "Team") {
+		t.Error("leave hooks not run for a deleted room")
+	}
+	removeClient("bob", clients.list)
+	if !hook.left("bob", "public") {
+		t.Error("leave hooks not run on disconnect")
+	}
+	netsplit("beta")
+	if !hook.left("carol", "public") {
+		t.Error("leave hooks not run for a nick lost in a netsplit")
+	}
+}
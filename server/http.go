@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+)
+
+// serveHTTP starts the optional http listener for monitoring endpoints
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/rooms", apiAuth(roomsHandler))
+	mux.HandleFunc("/rooms/", apiAuth(roomHandler))
+	mux.HandleFunc("/clients", apiAuth(clientsHandler))
+	mux.HandleFunc("/hooks/", incomingHookHandler)
+	logInfo("http listening", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logError("http server stopped", "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shaynewang/mirc"
+)
+
+// A client can ignore nicks: their private messages, room messages, typing
+// notifications and mentions are no longer delivered to it, on any of its
+// devices. The sender isn't told. Ignore lists of registered nicks are
+// persisted, those of guests go away with them. Ignored nicks follow nick
+// changes, but a guest who reconnects under another nick is no longer
+// ignored.
+
+const ignoreFile = "ignores.json"
+
+// nicks one client can ignore
+const maxIgnores = 100
+
+/******************** types ********************/
+type ignoreList struct {
+	mu sync.Mutex
+	// ignored nicks by nick
+	list map[string][]string
+}
+
+/********************* Globals ******************/
+
+// ignore lists of connected and registered nicks
+var ignores = ignoreList{
+	mu:   sync.Mutex{},
+	list: map[string][]string{},
+}
+
+/********************** Ignore funtions *****************/
+// add puts a nick on the ignore list of another
+func (l *ignoreList) add(nick string, ignored string) error {
+	if err := mirc.ValidateNick(ignored); err != nil {
+		return err
+	}
+	if fold(ignored) == fold(nick) || fold(ignored) == "server" {
+		return errors.New("cannot ignore " + ignored)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := l.list[fold(nick)]
+	if containFold(list, ignored) >= 0 {
+		return errors.New(ignored + " is already ignored")
+	}
+	if len(list) >= maxIgnores {
+		return errors.New("ignore list is full")
+	}
+	l.list[fold(nick)] = append(list, ignored)
+	return l.persist(nick)
+}
+
+// remove takes a nick off the ignore list of another
+func (l *ignoreList) remove(nick string, ignored string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := l.list[fold(nick)]
+	i := containFold(list, ignored)
+	if i < 0 {
+		return errors.New(ignored + " is not ignored")
+	}
+	l.list[fold(nick)] = append(list[:i], list[i+1:]...)
+	return l.persist(nick)
+}
+
+// ignoring reports whether nick ignores sender
+func (l *ignoreList) ignoring(nick string, sender string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return containFold(l.list[fold(nick)], sender) >= 0
+}
+
+// sorted returns the ignore list of a nick in order
+func (l *ignoreList) sorted(nick string) []string {
+	l.mu.Lock()
+	list := append([]string{}, l.list[fold(nick)]...)
+	l.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return fold(list[i]) < fold(list[j]) })
+	return list
+}
+
+// forget drops the ignore list of a nick
+func (l *ignoreList) forget(nick string) {
+	l.mu.Lock()
+	delete(l.list, fold(nick))
+	l.mu.Unlock()
+}
+
+// rename moves the ignore list of a nick to its new nick and renames it in
+// the lists that ignore it
+func (l *ignoreList) rename(oldNick string, newNick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if list, ok := l.list[fold(oldNick)]; ok {
+		delete(l.list, fold(oldNick))
+		l.list[fold(newNick)] = list
+	}
+	changed := false
+	for nick, list := range l.list {
+		i := containFold(list, oldNick)
+		if i < 0 {
+			continue
+		}
+		if j := containFold(list, newNick); j >= 0 && j != i {
+			list = append(list[:i], list[i+1:]...)
+		} else {
+			list[i] = newNick
+		}
+		l.list[nick] = list
+		changed = changed || accounts.registered(nick)
+	}
+	if changed {
+		if err := l.save(); err != nil {
+			logError("cannot save ignore lists", "err", err)
+		}
+	}
+}
+
+// persist saves the lists if nick is registered, assumes lock is held
+func (l *ignoreList) persist(nick string) error {
+	if !accounts.registered(nick) {
+		return nil
+	}
+	return l.save()
+}
+
+// save persists the ignore lists of registered nicks, assumes lock is held
+func (l *ignoreList) save() error {
+	saved := map[string][]string{}
+	for nick, list := range l.list {
+		if accounts.registered(nick) {
+			saved[nick] = list
+		}
+	}
+	return saveState(ignoreFile, saved)
+}
+
+// load reads the persisted ignore lists
+func (l *ignoreList) load() error {
+	saved := map[string][]string{}
+	if err := loadState(ignoreFile, &saved); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for nick, list := range saved {
+		l.list[fold(nick)] = list
+	}
+	return nil
+}
+
+// ignoreHandler ignores the nick in the body
+func (c *client) ignoreHandler(m *mirc.Message) {
+	nick := strings.TrimSpace(m.Body)
+	if err := ignores.add(c.Nick, nick); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "ignoring "+nick))
+	logDebug("nick ignored", "nick", c.Nick, "ignored", nick)
+}
+
+// unignoreHandler stops ignoring the nick in the body
+func (c *client) unignoreHandler(m *mirc.Message) {
+	nick := strings.TrimSpace(m.Body)
+	if err := ignores.remove(c.Nick, nick); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "no longer ignoring "+nick))
+	logDebug("nick unignored", "nick", c.Nick, "ignored", nick)
+}
+
+// listIgnoresHandler replies with the ignore list of the client
+func (c *client) listIgnoresHandler() {
+	c.send(newMsg(mirc.SERVER_RPL_LIST_IGNORES, c.Nick, strings.Join(ignores.sorted(c.Nick), " ,")))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestIgnoreList(t *testing.T) {
+	savedIgnores := ignores.list
+	defer func() { ignores.list = savedIgnores }()
+	ignores.list = map[string][]string{}
+	if err := ignores.add("alice", "Bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ignores.add("ALICE", "bob"); err == nil {
+		t.Error("ignored the same nick twice")
+	}
+	for _, nick := range []string{"alice", "server", "bad nick"} {
+		if err := ignores.add("alice", nick); err == nil {
+			t.Errorf("ignored %q", nick)
+		}
+	}
+	ignores.add("alice", "carol")
+	if !ignores.ignoring("Alice", "BOB") || ignores.ignoring("bob", "alice") {
+		t.Error("ignore list doesn't match nicks case-insensitively or one way only")
+	}
+	if list := ignores.sorted("alice"); len(list) != 2 || list[0] != "Bob" {
+		t.Errorf("unexpected ignore list %v", list)
+	}
+	if err := ignores.remove("alice", "BOB"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ignores.remove("alice", "bob"); err == nil {
+		t.Error("removed a nick that is not ignored")
+	}
+	ignores.rename("alice", "dave")
+	if !ignores.ignoring("dave", "carol") || ignores.ignoring("dave", "bob") {
+		t.Errorf("ignore list was not renamed: %v", ignores.list)
+	}
+	ignores.rename("carol", "erin")
+	if !ignores.ignoring("dave", "erin") || ignores.ignoring("dave", "carol") {
+		t.Errorf("ignored nick was not renamed: %v", ignores.list)
+	}
+	ignores.forget("dave")
+	if _, ok := ignores.list["dave"]; ok {
+		t.Error("ignore list was not forgotten")
+	}
+}
+
+func TestIgnoreRelayedBroadcast(t *testing.T) {
+	savedConf, savedClients, savedRooms, savedIgnores := config, clients.list, rooms.list, ignores.list
+	defer func() {
+		config, clients.list, rooms.list, ignores.list = savedConf, savedClients, savedRooms, savedIgnores
+	}()
+	config.DataDir = ""
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	carol, carolMsgs := testClient("carol", "10.0.0.3:5000")
+	clients.list = map[string]client{"alice": alice, "carol": carol, "bob": {Nick: "bob", Server: "beta"}}
+	rooms.list = map[string]room{"lobby": {Name: "lobby", Members: []string{"alice", "bob", "carol"}}}
+	ignores.list = map[string][]string{"carol": {"bob"}}
+
+	metrics.fanout.mu.Lock()
+	sum := metrics.fanout.sum
+	metrics.fanout.mu.Unlock()
+	m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "lobby", "hello from beta")
+	m.Header.Sender = "bob"
+	stampMsg(m)
+	rooms.mu.Lock()
+	deliverBroadcast(m, "beta")
+	rooms.unlock()
+	expectMsg(t, aliceMsgs, mirc.SERVER_BROADCAST_MESSAGE)
+	select {
+	case m := <-carolMsgs:
+		t.Errorf("message of an ignored nick delivered: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	metrics.fanout.mu.Lock()
+	defer metrics.fanout.mu.Unlock()
+	if n := metrics.fanout.sum - sum; n != 1 {
+		t.Errorf("expected a fanout of 1, got %v", n)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shaynewang/mirc"
+)
+
+const incomingHookFile = "incoming_hooks.json"
+
+// largest request body accepted by an incoming webhook
+const incomingHookMaxBody = 64 * 1024
+
+/******************** types ********************/
+// incomingHook binds a secret token to a room and the name messages appear with
+type incomingHook struct {
+	Token   string `json:"token"`
+	Room    string `json:"room"`
+	Sender  string `json:"sender"`
+	Creator string `json:"creator"`
+}
+type incomingHookList struct {
+	mu   sync.Mutex
+	list map[string]incomingHook
+}
+
+// incomingHookRequest is the json body posted to an incoming webhook
+type incomingHookRequest struct {
+	Body string `json:"body"`
+}
+
+/********************* Globals ******************/
+
+// incoming webhooks by token
+var incomingHooks = incomingHookList{
+	mu:   sync.Mutex{},
+	list: map[string]incomingHook{},
+}
+
+/********************** Incoming webhook funtions *****************/
+// newToken returns a random hex token
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create adds a webhook for an existing room and persists the list. The
+// sender must be a valid nick that no user is connected or registered with
+func (l *incomingHookList) create(roomName string, sender string, creator string) (incomingHook, error) {
+	if err := mirc.ValidateNick(sender); err != nil {
+		return incomingHook{}, err
+	}
+	clients.mu.Lock()
+	_, connected := clients.list[fold(sender)]
+	clients.mu.Unlock()
+	if connected || accounts.registered(sender) {
+		return incomingHook{}, errors.New("sender " + sender + " is the nick of a user")
+	}
+	rooms.mu.Lock()
+	r, ok := rooms.list[fold(roomName)]
+	rooms.unlock()
+	if !ok {
+		return incomingHook{}, errors.New("room " + roomName + " doesn't exist")
+	}
+	token, err := newToken()
+	if err != nil {
+		return incomingHook{}, err
+	}
+	h := incomingHook{Token: token, Room: r.Name, Sender: sender, Creator: creator}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.list[token] = h
+	return h, l.save()
+}
+
+// revoke deletes a webhook and persists the list
+func (l *incomingHookList) revoke(token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.list[token]; !ok {
+		return errors.New("no such webhook token")
+	}
+	delete(l.list, token)
+	return l.save()
+}
+
+// get looks up a webhook by token
+func (l *incomingHookList) get(token string) (incomingHook, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h, ok := l.list[token]
+	return h, ok
+}
+
+// sorted returns all webhooks ordered by room
+func (l *incomingHookList) sorted() []incomingHook {
+	l.mu.Lock()
+	list := make([]incomingHook, 0, len(l.list))
+	for _, h := range l.list {
+		list = append(list, h)
+	}
+	l.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Room != list[j].Room {
+			return list[i].Room < list[j].Room
+		}
+		return list[i].Token < list[j].Token
+	})
+	return list
+}
+
+// save persists the webhooks, assumes lock is held
+func (l *incomingHookList) save() error {
+	list := make([]incomingHook, 0, len(l.list))
+	for _, h := range l.list {
+		list = append(list, h)
+	}
+	return saveState(incomingHookFile, list)
+}
+
+// load reads the persisted webhooks
+func (l *incomingHookList) load() error {
+	var list []incomingHook
+	if err := loadState(incomingHookFile, &list); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, h := range list {
+		l.list[h.Token] = h
+	}
+	return nil
+}
+
+// sayInRoom broadcasts a message to a room as sender if the room exists
+func sayInRoom(roomName string, sender string, body string) error {
+	msg := newMsg(mirc.SERVER_BROADCAST_MESSAGE, roomName, body)
+	msg.Header.Sender = sender
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	if _, ok := rooms.list[fold(roomName)]; !ok {
+		return errors.New("room " + roomName + " doesn't exist")
+	}
+	broadCastMsg(msg)
+	return nil
+}
+
+// incomingHookHandler broadcasts a posted message into the room of the token
+func incomingHookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	h, ok := incomingHooks.get(strings.TrimPrefix(r.URL.Path, "/hooks/"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown webhook")
+		return
+	}
+	var req incomingHookRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, incomingHookMaxBody)).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Body) == "" {
+		writeError(w, http.StatusBadRequest, "expected a json object with a non-empty body")
+		return
+	}
+	if err := sayInRoom(h.Room, h.Sender, req.Body); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	logInfo("incoming webhook", "room", h.Room, "sender", h.Sender, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// createHookHandler creates an incoming webhook for the room in the receiver
+// field, the body holds the sender name messages will appear with
+func (c *client) createHookHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	if m.Header.Receiver == "" || m.Body == "" {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "please specify a room and a sender name"))
+		return
+	}
+	h, err := incomingHooks.create(m.Header.Receiver, m.Body, c.Nick)
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "webhook for "+h.Room+" created, POST to /hooks/"+h.Token))
+	logInfo("incoming webhook created", "oper", c.Nick, "room", h.Room, "sender", h.Sender)
+}
+
+// revokeHookHandler deletes the incoming webhook with the token in the body
+func (c *client) revokeHookHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	if err := incomingHooks.revoke(m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "webhook revoked"))
+	logInfo("incoming webhook revoked", "oper", c.Nick)
+}
+
+// listHooksHandler replies with all incoming webhooks
+func (c *client) listHooksHandler() {
+	if !c.isOper() {
+		return
+	}
+	var lines []string
+	for _, h := range incomingHooks.sorted() {
+		lines = append(lines, h.Room+" as "+h.Sender+": "+h.Token)
+	}
+	c.send(newMsg(mirc.SERVER_RPL_LIST_HOOKS, c.Nick, strings.Join(lines, " ,")))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestIncomingHooks(t *testing.T) {
+	savedConf, savedClients, savedRooms := config, clients.list, rooms.list
+	savedAccounts, savedHooks := accounts.list, incomingHooks.list
+	defer func() {
+		config, clients.list, rooms.list = savedConf, savedClients, savedRooms
+		accounts.list, incomingHooks.list = savedAccounts, savedHooks
+	}()
+	config.DataDir = ""
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	clients.list = map[string]client{"alice": alice}
+	rooms.list = map[string]room{"team": {Name: "Team", Members: []string{"alice"}}}
+	accounts.list = map[string]account{"bob": {Nick: "bob"}}
+	incomingHooks.list = map[string]incomingHook{}
+
+	for _, sender := range []string{"Alice", "bob", "server", "ci bot", "9bot"} {
+		if _, err := incomingHooks.create("team", sender, "root"); err == nil {
+			t.Errorf("webhook created with sender %q", sender)
+		}
+	}
+	if _, err := incomingHooks.create("lobby", "ci", "root"); err == nil {
+		t.Error("webhook created for a room that doesn't exist")
+	}
+	h, err := incomingHooks.create("team", "ci", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := incomingHooks.get(h.Token); !ok || got.Room != "Team" || got.Sender != "ci" {
+		t.Errorf("unexpected webhook %+v", got)
+	}
+	if _, ok := incomingHooks.get("nope"); ok {
+		t.Error("unknown token found")
+	}
+
+	post := func(method string, token string, body string) int {
+		w := httptest.NewRecorder()
+		incomingHookHandler(w, httptest.NewRequest(method, "/hooks/"+token, strings.NewReader(body)))
+		return w.Code
+	}
+	if code := post(http.MethodGet, h.Token, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered with %d", code)
+	}
+	if code := post(http.MethodPost, "nope", `{"body": "hi"}`); code != http.StatusNotFound {
+		t.Errorf("unknown token answered with %d", code)
+	}
+	for _, body := range []string{"", `{"body": "  "}`, "not json", `{"body": "` + strings.Repeat("a", incomingHookMaxBody) + `"}`} {
+		if code := post(http.MethodPost, h.Token, body); code != http.StatusBadRequest {
+			t.Errorf("body of %d bytes answered with %d", len(body), code)
+		}
+	}
+	if code := post(http.MethodPost, h.Token, `{"body": "build passed"}`); code != http.StatusOK {
+		t.Fatalf("message answered with %d", code)
+	}
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_BROADCAST_MESSAGE); m.Header.Sender != "ci" || m.Body != "build passed" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const banFile = "bans.json"
+
+/******************** types ********************/
+type connLimiter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+type banList struct {
+	mu      sync.Mutex
+	entries []string
+	nets    []*net.IPNet
+}
+
+/********************* Globals ******************/
+
+// number of open connections on the server
+var limiter = connLimiter{
+	mu:    sync.Mutex{},
+	perIP: map[string]int{},
+}
+
+// list of banned addresses and ranges
+var bans = banList{
+	mu: sync.Mutex{},
+}
+
+/********************** Limit funtions *****************/
+// remoteIP returns the ip part of a connection's remote address
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// admit reserves a connection slot for ip, it fails if the ip is banned or
+// any of the connection limits has been reached
+func (l *connLimiter) admit(ip net.IP) error {
+	if bans.match(ip) {
+		return errors.New("you are banned from this server")
+	}
+	conf := currentConfig()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if conf.MaxConnections > 0 && l.total >= conf.MaxConnections {
+		return errors.New("server is full")
+	}
+	key := ip.String()
+	if conf.MaxConnectionsPerIP > 0 && l.perIP[key] >= conf.MaxConnectionsPerIP {
+		return errors.New("too many connections from your address")
+	}
+	l.total++
+	l.perIP[key]++
+	return nil
+}
+
+// release frees a connection slot previously reserved by admit
+func (l *connLimiter) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ip.String()
+	l.total--
+	l.perIP[key]--
+	if l.perIP[key] <= 0 {
+		delete(l.perIP, key)
+	}
+}
+
+// parseBan turns a single address or a CIDR range into a network
+func parseBan(entry string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, errors.New("invalid address or range " + entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// match reports whether ip is covered by any ban
+func (b *banList) match(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, n := range b.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// add bans an address or range and persists the list
+func (b *banList) add(entry string) error {
+	ipNet, err := parseBan(entry)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if contain(b.entries, entry) >= 0 {
+		return errors.New(entry + " is already banned")
+	}
+	b.entries = append(b.entries, entry)
+	b.nets = append(b.nets, ipNet)
+	return saveState(banFile, b.entries)
+}
+
+// remove lifts a ban and persists the list
+func (b *banList) remove(entry string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := contain(b.entries, entry)
+	if i < 0 {
+		return errors.New(entry + " is not banned")
+	}
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+	b.nets = append(b.nets[:i], b.nets[i+1:]...)
+	return saveState(banFile, b.entries)
+}
+
+// list returns a copy of all ban entries
+func (b *banList) list() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.entries...)
+}
+
+// load reads the persisted ban list, invalid entries are skipped
+func (b *banList) load() error {
+	var entries []string
+	if err := loadState(banFile, &entries); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries, b.nets = nil, nil
+	for _, entry := range entries {
+		ipNet, err := parseBan(entry)
+		if err != nil {
+			continue
+		}
+		b.entries = append(b.entries, entry)
+		b.nets = append(b.nets, ipNet)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBanMatch(t *testing.T) {
+	dataDir := config.DataDir
+	t.Cleanup(func() { config.DataDir = dataDir })
+	config.DataDir = ""
+	b := banList{}
+	for _, entry := range []string{"10.0.0.1", "192.168.0.0/16", "2001:db8::/32"} {
+		if err := b.add(entry); err != nil {
+			t.Fatalf("cannot ban %s: %v", entry, err)
+		}
+	}
+	var tests = []struct {
+		ip     string
+		banned bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"192.168.42.7", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, test := range tests {
+		if b.match(net.ParseIP(test.ip)) != test.banned {
+			t.Errorf("match(%s) should be %v", test.ip, test.banned)
+		}
+	}
+	if err := b.remove("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if b.match(net.ParseIP("10.0.0.1")) {
+		t.Error("10.0.0.1 is still banned after removal")
+	}
+	if err := b.add("not-an-ip"); err == nil {
+		t.Error("invalid ban entry was accepted")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	config.MaxConnections, config.MaxConnectionsPerIP = 3, 2
+	defer func() { config.MaxConnections, config.MaxConnectionsPerIP = 0, 0 }()
+	l := connLimiter{perIP: map[string]int{}}
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	if l.admit(a) != nil || l.admit(a) != nil {
+		t.Fatal("first two connections should be admitted")
+	}
+	if l.admit(a) == nil {
+		t.Error("per address limit was not enforced")
+	}
+	if l.admit(b) != nil {
+		t.Fatal("connection from another address should be admitted")
+	}
+	if l.admit(b) == nil {
+		t.Error("total limit was not enforced")
+	}
+	l.release(a)
+	if l.admit(b) != nil {
+		t.Error("released slot was not reused")
+	}
+}
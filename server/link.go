@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Linked servers share nicks and room memberships and relay room and private
+// messages to each other. Every server keeps the full nick and membership
+// state; a remote client is stored with the name of the link it is reached
+// through. Links have to form a tree, a server must not be reachable over
+// two links.
+
+// Link parameters
+const linkRetry = 5
+const linkPing = 10
+
+/******************** types ********************/
+type link struct {
+	name string
+	conn *mirc.Connection
+}
+type linkList struct {
+	mu   sync.Mutex
+	list map[string]*link
+}
+
+/********************* Globals ******************/
+
+// list of established server links
+var links = linkList{
+	mu:   sync.Mutex{},
+	list: map[string]*link{},
+}
+
+/********************** Link funtions *****************/
+// newLinkMsg creates a message for a linked server
+func newLinkMsg(opCode int16, receiver string, body string) *mirc.Message {
+	msg := mirc.NewMsg(opCode, receiver, body)
+	msg.Header.Sender = currentConfig().ServerName
+	return msg
+}
+
+// findLinkConf returns the configuration of the link to a server
+func findLinkConf(name string) *linkConf {
+	links := currentConfig().Links
+	for i := range links {
+		if links[i].Name == name {
+			return &links[i]
+		}
+	}
+	return nil
+}
+
+// origin returns the link a nick is reached through, empty for local nicks
+func origin(nick string) string {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	return clients.list[fold(nick)].Server
+}
+
+// add registers an established link, it fails if the server is already linked
+func (l *linkList) add(lk *link) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.list[lk.name]; ok {
+		return false
+	}
+	l.list[lk.name] = lk
+	return true
+}
+
+// remove forgets a link
+func (l *linkList) remove(name string) {
+	l.mu.Lock()
+	delete(l.list, name)
+	l.mu.Unlock()
+}
+
+// count returns the number of established links
+func (l *linkList) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.list)
+}
+
+// relay passes a message to a linked server as it is
+func (l *linkList) relay(name string, m *mirc.Message) error {
+	l.mu.Lock()
+	lk, ok := l.list[name]
+	l.mu.Unlock()
+	if !ok {
+		return errors.New("no link to " + name)
+	}
+	return lk.conn.SendMsg(m)
+}
+
+// announce sends a state change to every link except the one it came from
+func (l *linkList) announce(m *mirc.Message, except string) {
+	l.mu.Lock()
+	var targets []*link
+	for name, lk := range l.list {
+		if name != except {
+			targets = append(targets, lk)
+		}
+	}
+	l.mu.Unlock()
+	for _, lk := range targets {
+		lk.conn.SendMsg(m)
+	}
+}
+
+// route wraps a message for a single remote nick and passes it down the link
+func (l *linkList) route(name string, nick string, m *mirc.Message) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return l.relay(name, newLinkMsg(mirc.SERVER_LINK_ROUTE, nick, string(body)))
+}
+
+// addRemoteClient records a nick introduced by a linked server
+func addRemoteClient(nick string, from string) {
+	if err := mirc.ValidateNick(nick); err != nil {
+		logWarn("invalid nick on link", "nick", nick, "link", from, "err", err)
+		return
+	}
+	clients.mu.Lock()
+	if existing, ok := clients.list[fold(nick)]; ok {
+		clients.mu.Unlock()
+		if existing.Server != from {
+			collide(nick, from)
+		}
+		return
+	}
+	now := time.Now()
+	clients.list[fold(nick)] = client{Nick: nick, Server: from, Connected: now, LastActive: now}
+	clients.mu.Unlock()
+	links.announce(newLinkMsg(mirc.SERVER_LINK_NICK, "", nick), from)
+}
+
+// collide kills both holders of a nick two servers disagree about, the one
+// known here and the one behind the link from. The other server does the
+// same when it sees the collision
+func collide(nick string, from string) {
+	logWarn("nick collision on link, killing both", "nick", nick, "link", from)
+	killNick(nick, "nick collision", from)
+	links.relay(from, newLinkMsg(mirc.SERVER_LINK_KILL, nick, "nick collision"))
+}
+
+// killNick disconnects a nick wherever it is connected, a nick behind a link
+// is killed by its own server. Nicks reached through except are left alone
+func killNick(nick string, reason string, except string) {
+	clients.mu.Lock()
+	c, ok := clients.list[fold(nick)]
+	clients.mu.Unlock()
+	if !ok || c.Server == except {
+		return
+	}
+	if c.Server == "" {
+		disconnect(c.Nick, "collision", reason)
+		return
+	}
+	links.relay(c.Server, newLinkMsg(mirc.SERVER_LINK_KILL, c.Nick, reason))
+	removeClient(c.Nick, clients.list)
+}
+
+// burst introduces all nicks and memberships this side knows to a new link
+func (lk *link) burst() {
+	var nicks []string
+	var joins []*mirc.Message
+	rooms.mu.Lock()
+	clients.mu.Lock()
+	for _, c := range clients.list {
+		if c.Server != lk.name {
+			nicks = append(nicks, c.Nick)
+		}
+	}
+	for _, r := range rooms.list {
+		for _, nick := range r.Members {
+			if c, ok := clients.list[fold(nick)]; ok && c.Server != lk.name {
+				joins = append(joins, newLinkMsg(mirc.SERVER_LINK_JOIN, r.Name, nick))
+			}
+		}
+	}
+	clients.mu.Unlock()
+	rooms.unlock()
+	for _, nick := range nicks {
+		lk.conn.SendMsg(newLinkMsg(mirc.SERVER_LINK_NICK, "", nick))
+		if away := awayStatus(nick); away != "" {
+			lk.conn.SendMsg(newLinkMsg(mirc.SERVER_LINK_AWAY, nick, away))
+		}
+	}
+	for _, m := range joins {
+		lk.conn.SendMsg(m)
+	}
+}
+
+// handle applies one message received from a linked server
+// membership changes are only accepted for nicks reached through this link
+func (lk *link) handle(opCode int16, m *mirc.Message) {
+	if opCode == mirc.CONNECTION_PING {
+		lk.conn.SendMsg(newLinkMsg(mirc.CONNECTION_ACK, "", "pong"))
+	} else if opCode == mirc.SERVER_LINK_NICK {
+		addRemoteClient(m.Body, lk.name)
+	} else if opCode == mirc.SERVER_LINK_QUIT {
+		if origin(m.Body) == lk.name {
+			removeClient(m.Body, clients.list)
+		}
+	} else if opCode == mirc.SERVER_LINK_KILL {
+		killNick(m.Header.Receiver, m.Body, lk.name)
+	} else if opCode == mirc.SERVER_LINK_AWAY {
+		if origin(m.Header.Receiver) == lk.name {
+			setAway(m.Header.Receiver, m.Body, false)
+		}
+	} else if opCode == mirc.SERVER_LINK_RENAME {
+		if origin(m.Header.Receiver) != lk.name {
+			return
+		}
+		if err := renameClient(m.Header.Receiver, m.Body); err != nil {
+			// the old nick is gone on the other side either way
+			removeClient(m.Header.Receiver, clients.list)
+			collide(m.Body, lk.name)
+		}
+	} else if opCode == mirc.SERVER_LINK_JOIN {
+		if origin(m.Body) != lk.name {
+			return
+		}
+		if err := mirc.ValidateRoom(m.Header.Receiver); err != nil {
+			logWarn("invalid room on link", "room", m.Header.Receiver, "link", lk.name, "err", err)
+			return
+		}
+		rooms.mu.Lock()
+		r, ok := rooms.list[fold(m.Header.Receiver)]
+		if !ok {
+			r = room{Name: m.Header.Receiver, Created: time.Now()}
+		}
+		r.addMember(m.Body)
+		rooms.list[fold(r.Name)] = r
+		rooms.unlock()
+	} else if opCode == mirc.SERVER_LINK_PART {
+		if origin(m.Body) != lk.name {
+			return
+		}
+		rooms.mu.Lock()
+		if r, ok := rooms.list[fold(m.Header.Receiver)]; ok {
+			r.removeMember(m.Body)
+			if len(r.Members) > 0 || r.permanent() {
+				rooms.list[fold(r.Name)] = r
+			}
+		}
+		rooms.unlock()
+	} else if opCode == mirc.SERVER_TYPING {
+		if origin(m.Header.Sender) == lk.name {
+			deliverTyping(m, lk.name)
+		}
+	} else if opCode == mirc.SERVER_BROADCAST_MESSAGE || opCode == mirc.SERVER_MESSAGE_EDITED ||
+		opCode == mirc.SERVER_MESSAGE_DELETED {
+		rooms.mu.Lock()
+		deliverBroadcast(m, lk.name)
+		r, ok := rooms.list[fold(m.Header.Receiver)]
+		rooms.unlock()
+		if ok && opCode == mirc.SERVER_BROADCAST_MESSAGE {
+			recordMentions(m, r)
+		}
+	} else if opCode == mirc.SERVER_LINK_ROUTE {
+		inner := new(mirc.Message)
+		if err := json.Unmarshal([]byte(m.Body), inner); err != nil {
+			logWarn("invalid routed message", "link", lk.name, "err", err)
+			return
+		}
+		clients.mu.Lock()
+		target, ok := clients.list[fold(m.Header.Receiver)]
+		clients.mu.Unlock()
+		if inner.Header.OpCode == mirc.SERVER_TYPING && target.Server == "" && !typingDevices(&target) {
+			// opted out, or detached and typing is never buffered
+			return
+		}
+		if ok && target.Server != lk.name && !ignores.ignoring(target.Nick, inner.Header.Sender) {
+			target.send(inner)
+		}
+	}
+}
+
+// netsplit removes every nick reached through a lost link and tells the
+// rooms they were in
+func netsplit(name string) {
+	var lost []string
+	clients.mu.Lock()
+	for _, c := range clients.list {
+		if c.Server == name {
+			lost = append(lost, c.Nick)
+		}
+	}
+	clients.mu.Unlock()
+	reason := " has quit (netsplit " + currentConfig().ServerName + " <-> " + name + ")"
+	rooms.mu.Lock()
+	for _, nick := range lost {
+		for _, roomName := range roomsOf(nick) {
+			deliverBroadcast(newMsg(mirc.SERVER_BROADCAST_MESSAGE, roomName, nick+reason), name)
+		}
+	}
+	rooms.unlock()
+	for _, nick := range lost {
+		removeClient(nick, clients.list)
+	}
+	logWarn("netsplit", "link", name, "lost", len(lost))
+}
+
+// keepAlive pings the linked server until stop is closed
+func (lk *link) keepAlive(stop chan struct{}) {
+	ticker := time.NewTicker(linkPing * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			lk.conn.SendMsg(newLinkMsg(mirc.CONNECTION_PING, "", "ping"))
+		}
+	}
+}
+
+// runLink serves an authenticated link until the connection drops
+func runLink(name string, con *mirc.Connection) {
+	lk := &link{name: name, conn: con}
+	if !links.add(lk) {
+		logWarn("server already linked", "link", name, "remote", con.RemoteAddr())
+		return
+	}
+	logInfo("link established", "link", name, "remote", con.RemoteAddr())
+	if msgIDTag(name) == msgIDTag(currentConfig().ServerName) {
+		logWarn("linked server makes message ids like ours, rename one of the servers", "link", name)
+	}
+	stop := make(chan struct{})
+	go lk.keepAlive(stop)
+	lk.burst()
+	for {
+		con.Conn.SetReadDeadline(mirc.CalDeadline(inactiveTimeout))
+		opCode, msg := con.GetMsg()
+		if opCode == mirc.ERROR {
+			break
+		}
+		lk.handle(opCode, msg)
+	}
+	close(stop)
+	links.remove(name)
+	con.Conn.Close()
+	netsplit(name)
+}
+
+// acceptLink authenticates a server that connected to us and serves the link
+func acceptLink(con *mirc.Connection, m *mirc.Message) {
+	lc := findLinkConf(m.Header.Sender)
+	if lc == nil || subtle.ConstantTimeCompare([]byte(lc.Password), []byte(m.Body)) != 1 {
+		logWarn("link refused", "link", m.Header.Sender, "remote", con.RemoteAddr())
+		return
+	}
+	if err := con.SendMsg(newLinkMsg(mirc.SERVER_LINK, "", lc.Password)); err != nil {
+		return
+	}
+	runLink(lc.Name, con)
+}
+
+// dialLink keeps a configured link up, reconnecting when it drops
+func dialLink(lc linkConf) {
+	for {
+		conn, err := net.DialTimeout("tcp", lc.Addr, timeout*time.Second)
+		if err == nil {
+			con := &mirc.Connection{Conn: conn}
+			con.SendMsg(newLinkMsg(mirc.SERVER_LINK, "", lc.Password))
+			con.Conn.SetReadDeadline(mirc.CalDeadline(timeout))
+			opCode, msg := con.GetMsg()
+			if opCode == mirc.SERVER_LINK && msg.Header.Sender == lc.Name &&
+				subtle.ConstantTimeCompare([]byte(lc.Password), []byte(msg.Body)) == 1 {
+				runLink(lc.Name, con)
+			} else {
+				err = errors.New("link rejected")
+			}
+			conn.Close()
+		}
+		if err != nil {
+			logWarn("cannot link", "link", lc.Name, "addr", lc.Addr, "err", err)
+		}
+		time.Sleep(linkRetry * time.Second)
+	}
+}
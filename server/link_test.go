@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// linkPeer accepts a link from a server named beta over a pipe, the messages
+// sent to beta arrive on the channel
+func linkPeer(password string) (*mirc.Connection, chan *mirc.Message, chan struct{}) {
+	server, peer := net.Pipe()
+	received := make(chan *mirc.Message, 100)
+	go func() {
+		in := &mirc.Connection{Conn: peer}
+		for {
+			opCode, m := in.GetMsg()
+			if opCode == mirc.ERROR {
+				close(received)
+				return
+			}
+			received <- m
+		}
+	}()
+	hello := mirc.NewMsg(mirc.SERVER_LINK, "", password)
+	hello.Header.Sender = "beta"
+	done := make(chan struct{})
+	go func() {
+		acceptLink(&mirc.Connection{Conn: server}, hello)
+		server.Close()
+		close(done)
+	}()
+	return &mirc.Connection{Conn: peer}, received, done
+}
+
+// fromBeta sends a message to the server as beta
+func fromBeta(t *testing.T, con *mirc.Connection, opCode int16, receiver string, body string) {
+	m := mirc.NewMsg(opCode, receiver, body)
+	m.Header.Sender = "beta"
+	if err := con.SendMsg(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// eventually waits for a condition the server reaches asynchronously
+func eventually(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal(what)
+}
+
+func TestLink(t *testing.T) {
+	savedConf, savedClients, savedRooms := config, clients.list, rooms.list
+	defer func() { config, clients.list, rooms.list = savedConf, savedClients, savedRooms }()
+	config.DataDir = ""
+	config.ServerName = "alpha"
+	config.Links = []linkConf{{Name: "beta", Password: "secret"}}
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	carol, carolMsgs := testClient("carol", "10.0.0.3:5000")
+	clients.mu.Lock()
+	clients.list = map[string]client{"alice": alice, "carol": carol}
+	clients.mu.Unlock()
+	rooms.mu.Lock()
+	rooms.list = map[string]room{"public": {Name: "public", Members: []string{"server", "alice", "carol"}}}
+	rooms.unlock()
+
+	_, refused, done := linkPeer("wrong")
+	<-done
+	if _, ok := <-refused; ok || links.count() != 0 {
+		t.Fatal("link with a wrong password accepted")
+	}
+
+	con, beta, done := linkPeer("secret")
+	if m := expectMsg(t, beta, mirc.SERVER_LINK); m.Header.Sender != "alpha" {
+		t.Errorf("unexpected link reply %+v", m)
+	}
+	burst := map[string]bool{}
+	for len(burst) < 4 {
+		select {
+		case m := <-beta:
+			burst[m.Header.Receiver+" "+m.Body] = true
+		case <-time.After(time.Second):
+			t.Fatalf("incomplete burst %v", burst)
+		}
+	}
+	if !burst[" alice"] || !burst["public alice"] || !burst[" carol"] || !burst["public carol"] {
+		t.Errorf("unexpected burst %v", burst)
+	}
+
+	fromBeta(t, con, mirc.SERVER_LINK_NICK, "", "bob")
+	fromBeta(t, con, mirc.SERVER_LINK_JOIN, "public", "bob")
+	eventually(t, "remote member not added", func() bool {
+		rooms.mu.Lock()
+		defer rooms.unlock()
+		return containFold(rooms.list["public"].Members, "bob") >= 0
+	})
+	if err := sayInRoom("public", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if m := expectMsg(t, beta, mirc.SERVER_BROADCAST_MESSAGE); m.Body != "hi" {
+		t.Errorf("unexpected relayed message %+v", m)
+	}
+	expectMsg(t, aliceMsgs, mirc.SERVER_BROADCAST_MESSAGE)
+	relayed := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "public", "hello")
+	relayed.Header.Sender = "bob"
+	con.SendMsg(relayed)
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_BROADCAST_MESSAGE); m.Header.Sender != "bob" || m.Body != "hello" {
+		t.Errorf("unexpected message from the link %+v", m)
+	}
+
+	// beta has its own carol, both are killed
+	fromBeta(t, con, mirc.SERVER_LINK_NICK, "", "carol")
+	if m := expectMsg(t, carolMsgs, mirc.CONNECTION_CLOSED); m.Body != "nick collision" {
+		t.Errorf("unexpected reason %q", m.Body)
+	}
+	if m := expectMsg(t, beta, mirc.SERVER_LINK_KILL); m.Header.Receiver != "carol" {
+		t.Errorf("unexpected kill %+v", m)
+	}
+
+	con.Close()
+	<-done
+	clients.mu.Lock()
+	_, ok := clients.list["bob"]
+	clients.mu.Unlock()
+	if ok || links.count() != 0 {
+		t.Error("nick behind a lost link is still known")
+	}
+	rooms.mu.Lock()
+	members := rooms.list["public"].Members
+	rooms.unlock()
+	if containFold(members, "bob") >= 0 {
+		t.Errorf("nick behind a lost link is still a member: %v", members)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/******************** types ********************/
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// logger writes leveled log lines with key value fields in logfmt or json
+type logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string
+}
+
+/********************* Globals ******************/
+
+// server wide logger, configured from logLevel and logFormat
+var serverLog = &logger{
+	out:    os.Stdout,
+	level:  levelInfo,
+	format: "logfmt",
+}
+
+/********************** Log funtions *****************/
+// parseLevel turns a level name from the configuration into a logLevel
+func parseLevel(name string) (logLevel, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return logLevel(i), nil
+		}
+	}
+	return levelInfo, errors.New("unknown log level " + name)
+}
+
+// configure applies the level and format from the configuration
+func (l *logger) configure(level string, format string) error {
+	lvl, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != "logfmt" && format != "json" {
+		return errors.New("unknown log format " + format)
+	}
+	l.mu.Lock()
+	l.level, l.format = lvl, format
+	l.mu.Unlock()
+	return nil
+}
+
+// log writes one line if level is enabled, fields are alternating keys and values
+func (l *logger) log(level logLevel, msg string, fields ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	keys := []string{"time", "level", "msg"}
+	values := []interface{}{time.Now().UTC().Format(time.RFC3339Nano), levelNames[level], msg}
+	for i := 0; i+1 < len(fields); i += 2 {
+		keys = append(keys, fmt.Sprint(fields[i]))
+		values = append(values, fields[i+1])
+	}
+	if l.format == "json" {
+		l.out.Write(encodeJSON(keys, values))
+	} else {
+		l.out.Write(encodeLogfmt(keys, values))
+	}
+}
+
+// encodeLogfmt renders a line as key=value pairs, quoting values when needed
+func encodeLogfmt(keys []string, values []interface{}) []byte {
+	var b bytes.Buffer
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		v := fieldString(values[i])
+		if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(k + "=" + v)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// encodeJSON renders a line as a json object keeping the key order
+func encodeJSON(keys []string, values []interface{}) []byte {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(values[i])
+		if err != nil || isStringer(values[i]) {
+			value, _ = json.Marshal(fieldString(values[i]))
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// isStringer reports whether v should be logged by its text form
+func isStringer(v interface{}) bool {
+	switch v.(type) {
+	case error, fmt.Stringer:
+		return true
+	}
+	return false
+}
+
+// fieldString formats a field value for logfmt
+func fieldString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func logDebug(msg string, fields ...interface{}) { serverLog.log(levelDebug, msg, fields...) }
+func logInfo(msg string, fields ...interface{})  { serverLog.log(levelInfo, msg, fields...) }
+func logWarn(msg string, fields ...interface{})  { serverLog.log(levelWarn, msg, fields...) }
+func logError(msg string, fields ...interface{}) { serverLog.log(levelError, msg, fields...) }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+	l := &logger{out: &buf}
+	if err := l.configure("info", "logfmt"); err != nil {
+		t.Fatal(err)
+	}
+	l.log(levelDebug, "hidden", "nick", "alice")
+	l.log(levelInfo, "room joined", "nick", "alice", "room", "dev ops")
+	line := buf.String()
+	if strings.Contains(line, "hidden") {
+		t.Error("debug line written at info level")
+	}
+	if !strings.Contains(line, `level=info msg="room joined" nick=alice room="dev ops"`) {
+		t.Errorf("unexpected logfmt line: %s", line)
+	}
+
+	buf.Reset()
+	if err := l.configure("debug", "json"); err != nil {
+		t.Fatal(err)
+	}
+	l.log(levelError, "write failed", "opcode", int16(206), "err", errors.New("broken pipe"))
+	line = buf.String()
+	if !strings.Contains(line, `"level":"error","msg":"write failed","opcode":206,"err":"broken pipe"}`) {
+		t.Errorf("unexpected json line: %s", line)
+	}
+
+	if err := l.configure("loud", "logfmt"); err == nil {
+		t.Error("unknown level was accepted")
+	}
+	if err := l.configure("info", "xml"); err == nil {
+		t.Error("unknown format was accepted")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/shaynewang/mirc"
+)
+
+// A read marker is the id of the last message a nick has read in a room. All
+// devices of a nick share it, moving it on one device moves it on the others.
+// Markers of registered nicks are persisted, those of guests go away with
+// them. Markers move often, changes are written by flushState in batches.
+
+const markerFile = "markers.json"
+
+/******************** types ********************/
+type markerList struct {
+	mu sync.Mutex
+	// last read message id by nick and room
+	list map[string]map[string]int64
+	// whether a persisted marker changed since the last save
+	dirty bool
+}
+
+/********************* Globals ******************/
+
+// read markers of connected and registered nicks
+var markers = markerList{
+	mu:   sync.Mutex{},
+	list: map[string]map[string]int64{},
+}
+
+/********************** Marker funtions *****************/
+// get returns the marker of a nick in a room, a room without one starts out
+// read up to its latest message
+func (l *markerList) get(nick string, roomName string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rooms, ok := l.list[fold(nick)]
+	if !ok {
+		rooms = map[string]int64{}
+		l.list[fold(nick)] = rooms
+	}
+	id, ok := rooms[fold(roomName)]
+	if !ok {
+		id = history.latest(roomName)
+		rooms[fold(roomName)] = id
+	}
+	return id
+}
+
+// has reports whether a nick has a marker in a room, nicks get one when they
+// join it
+func (l *markerList) has(nick string, roomName string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.list[fold(nick)][fold(roomName)]
+	return ok
+}
+
+// set moves the marker of a nick in a room forward, it reports whether the
+// marker moved
+func (l *markerList) set(nick string, roomName string, id int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rooms, ok := l.list[fold(nick)]
+	if !ok {
+		rooms = map[string]int64{}
+		l.list[fold(nick)] = rooms
+	}
+	if id <= rooms[fold(roomName)] {
+		return false
+	}
+	rooms[fold(roomName)] = id
+	if accounts.registered(nick) {
+		l.dirty = true
+	}
+	return true
+}
+
+// forget drops the markers of a nick
+func (l *markerList) forget(nick string) {
+	l.mu.Lock()
+	delete(l.list, fold(nick))
+	l.mu.Unlock()
+}
+
+// rename moves the markers of a nick to its new nick
+func (l *markerList) rename(oldNick string, newNick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rooms, ok := l.list[fold(oldNick)]; ok {
+		delete(l.list, fold(oldNick))
+		l.list[fold(newNick)] = rooms
+	}
+}
+
+// flush persists the markers if one of a registered nick changed
+func (l *markerList) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	if err := l.save(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// save persists the markers of registered nicks, assumes lock is held
+func (l *markerList) save() error {
+	saved := map[string]map[string]int64{}
+	for nick, rooms := range l.list {
+		if accounts.registered(nick) {
+			saved[nick] = rooms
+		}
+	}
+	return saveState(markerFile, saved)
+}
+
+// load reads the persisted markers
+func (l *markerList) load() error {
+	saved := map[string]map[string]int64{}
+	if err := loadState(markerFile, &saved); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for nick, rooms := range saved {
+		l.list[fold(nick)] = rooms
+	}
+	return nil
+}
+
+// readMarker describes the marker of a nick in a room with its unread count
+func readMarker(nick string, roomName string) mirc.ReadMarker {
+	lastRead := markers.get(nick, roomName)
+	unread, first := history.unread(roomName, nick, lastRead)
+	return mirc.ReadMarker{
+		Room:        roomName,
+		LastRead:    lastRead,
+		Unread:      unread,
+		FirstUnread: first,
+	}
+}
+
+// sendMarker sends the read marker of a room to the client
+func (c *client) sendMarker(roomName string) {
+	body, err := json.Marshal(readMarker(c.Nick, roomName))
+	if err != nil {
+		logError("cannot encode read marker", "room", roomName, "err", err)
+		return
+	}
+	c.send(newMsg(mirc.SERVER_READ_MARKER, c.Nick, string(body)))
+}
+
+// sendMarkers sends the read markers of every room the client is in
+func (c *client) sendMarkers() {
+	rooms.mu.Lock()
+	names := roomsOf(c.Nick)
+	rooms.unlock()
+	for _, name := range names {
+		c.sendMarker(name)
+	}
+}
+
+// markReadHandler moves the read marker of a room, the receiver field holds
+// the room and the body the id of the last message read, 0 marks the whole
+// room read. Every device of the client gets the new marker
+func (c *client) markReadHandler(m *mirc.Message) {
+	id, _, err := parseMsgRef(m.Body)
+	if err == nil && !c.inRoom(m.Header.Receiver) {
+		err = errors.New("not a member of the room")
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	if id == 0 {
+		id = history.latest(m.Header.Receiver)
+	}
+	if !markers.set(c.Nick, m.Header.Receiver, id) {
+		return
+	}
+	clients.mu.Lock()
+	cl := clients.list[fold(c.Nick)]
+	clients.mu.Unlock()
+	cl.sendMarker(m.Header.Receiver)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestReadMarkers(t *testing.T) {
+	savedHistory, savedMarkers := history.rooms, markers.list
+	defer func() { history.rooms, markers.list = savedHistory, savedMarkers }()
+	history.rooms = map[string][]*historyEntry{}
+	markers.list = map[string]map[string]int64{}
+	record := func(id int64, sender string) {
+		m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "lobby", "hello")
+		m.Header.Sender = sender
+		m.Header.ID = id
+		history.record(m, "")
+	}
+	record(1, "bob")
+	if rm := readMarker("alice", "Lobby"); rm.LastRead != 1 || rm.Unread != 0 {
+		t.Errorf("new marker is not at the latest message: %+v", rm)
+	}
+	record(2, "server")
+	record(3, "bob")
+	record(4, "alice")
+	record(5, "bob")
+	if rm := readMarker("ALICE", "lobby"); rm.Unread != 2 || rm.FirstUnread != 3 {
+		t.Errorf("expected 2 unread from id 3, got %+v", rm)
+	}
+	if !markers.set("alice", "lobby", 4) {
+		t.Error("marker did not move forward")
+	}
+	if markers.set("alice", "lobby", 3) {
+		t.Error("marker moved back")
+	}
+	if rm := readMarker("alice", "lobby"); rm.Unread != 1 || rm.FirstUnread != 5 {
+		t.Errorf("expected 1 unread from id 5, got %+v", rm)
+	}
+	markers.rename("alice", "carol")
+	if rm := readMarker("carol", "lobby"); rm.LastRead != 4 {
+		t.Errorf("marker was not renamed: %+v", rm)
+	}
+	markers.forget("carol")
+	if _, ok := markers.list["carol"]; ok {
+		t.Error("marker was not forgotten")
+	}
+	history.drop("lobby")
+}
+
+func TestFlushMarkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedConf, savedAccounts, savedMarkers := config, accounts.list, markers.list
+	defer func() { config, accounts.list, markers.list = savedConf, savedAccounts, savedMarkers }()
+	config.DataDir = dir
+	accounts.list = map[string]account{"alice": {Nick: "alice"}}
+	markers.list = map[string]map[string]int64{}
+	markers.dirty = false
+
+	markers.set("bob", "lobby", 1)
+	if markers.dirty {
+		t.Error("marker of a guest marked for saving")
+	}
+	markers.set("alice", "lobby", 1)
+	markers.set("alice", "lobby", 2)
+	path := filepath.Join(dir, markerFile)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("markers written before the flush")
+	}
+	if err := markers.flush(); err != nil {
+		t.Fatal(err)
+	}
+	markers.list = map[string]map[string]int64{}
+	if err := markers.load(); err != nil {
+		t.Fatal(err)
+	}
+	if markers.list["alice"]["lobby"] != 2 || markers.dirty {
+		t.Errorf("unexpected markers after a flush: %v", markers.list)
+	}
+}
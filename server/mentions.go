@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Room messages that mention a nick with "@nick" or "nick:" go to the
+// mentions inbox of the nick, so it can look them up later. Members of the
+// room and registered nicks get mentions, the inboxes of registered nicks
+// are persisted so they get mentions while they are offline. Changes are
+// written by flushState in batches.
+
+const mentionFile = "mentions.json"
+
+// mentions kept per nick
+const mentionInbox = 100
+
+/******************** types ********************/
+type mentionList struct {
+	mu   sync.Mutex
+	list map[string][]mirc.HistoryMessage
+	// whether a persisted inbox changed since the last save
+	dirty bool
+}
+
+/********************* Globals ******************/
+
+// mentions inbox by nick
+var mentions = mentionList{
+	mu:   sync.Mutex{},
+	list: map[string][]mirc.HistoryMessage{},
+}
+
+/********************** Mention funtions *****************/
+// add puts a message in the inbox of nick, the oldest mentions go when the
+// inbox is full
+func (l *mentionList) add(nick string, m mirc.HistoryMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inbox := append(l.list[fold(nick)], m)
+	if len(inbox) > mentionInbox {
+		inbox = inbox[len(inbox)-mentionInbox:]
+	}
+	l.list[fold(nick)] = inbox
+	if accounts.registered(nick) {
+		l.dirty = true
+	}
+}
+
+// inbox returns the mentions of a nick
+func (l *mentionList) inbox(nick string) []mirc.HistoryMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]mirc.HistoryMessage{}, l.list[fold(nick)]...)
+}
+
+// clear empties the inbox of a nick
+func (l *mentionList) clear(nick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.list, fold(nick))
+	l.dirty = true
+}
+
+// retract removes a deleted message from every inbox
+func (l *mentionList) retract(roomName string, id int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for nick, inbox := range l.list {
+		kept := inbox[:0]
+		for _, m := range inbox {
+			if m.ID != id || fold(m.Room) != fold(roomName) {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) < len(inbox) {
+			l.dirty = true
+		}
+		l.list[nick] = kept
+	}
+}
+
+// forget drops the inbox of a nick
+func (l *mentionList) forget(nick string) {
+	l.mu.Lock()
+	delete(l.list, fold(nick))
+	l.mu.Unlock()
+}
+
+// rename moves the inbox of a nick to its new nick
+func (l *mentionList) rename(oldNick string, newNick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if inbox, ok := l.list[fold(oldNick)]; ok {
+		delete(l.list, fold(oldNick))
+		l.list[fold(newNick)] = inbox
+	}
+}
+
+// flush persists the inboxes if one of a registered nick changed
+func (l *mentionList) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	if err := l.save(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// save persists the inboxes of registered nicks, assumes lock is held
+func (l *mentionList) save() error {
+	saved := map[string][]mirc.HistoryMessage{}
+	for nick, inbox := range l.list {
+		if accounts.registered(nick) {
+			saved[nick] = inbox
+		}
+	}
+	return saveState(mentionFile, saved)
+}
+
+// load reads the persisted inboxes
+func (l *mentionList) load() error {
+	saved := map[string][]mirc.HistoryMessage{}
+	if err := loadState(mentionFile, &saved); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for nick, inbox := range saved {
+		l.list[fold(nick)] = inbox
+	}
+	return nil
+}
+
+// recordMentions puts a message of room r in the inbox of every nick it
+// mentions that is a local member of the room. Registered nicks that are
+// offline get the mentions of the permanent public rooms they had joined
+func recordMentions(m *mirc.Message, r room) {
+	if m.Header.Sender == "server" {
+		return
+	}
+	for _, nick := range mirc.Mentions(m.Body) {
+		if fold(nick) == fold(m.Header.Sender) {
+			continue
+		}
+		clients.mu.Lock()
+		c, connected := clients.list[fold(nick)]
+		clients.mu.Unlock()
+		member := connected && c.Server == "" && containFold(r.Members, nick) >= 0
+		offline := !connected && accounts.registered(nick) && r.permanent() && !r.hasMode('s') && markers.has(nick, r.Name)
+		if (!member && !offline) || ignores.ignoring(nick, m.Header.Sender) {
+			continue
+		}
+		if connected {
+			nick = c.Nick
+		}
+		mentions.add(nick, mirc.HistoryMessage{
+			ID:     m.Header.ID,
+			Room:   r.Name,
+			Sender: m.Header.Sender,
+			Body:   m.Body,
+			Time:   m.Header.Time,
+			Parent: m.Header.Parent,
+		})
+	}
+}
+
+// mentionsHandler replies with the mentions inbox of the client as json,
+// "clear" in the body empties it
+func (c *client) mentionsHandler(m *mirc.Message) {
+	if m.Body == "clear" {
+		mentions.clear(c.Nick)
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "mentions cleared"))
+		return
+	}
+	body, err := json.Marshal(mentions.inbox(c.Nick))
+	if err != nil {
+		logError("cannot encode mentions", "nick", c.Nick, "err", err)
+		return
+	}
+	c.send(newMsg(mirc.SERVER_RPL_MENTIONS, c.Nick, string(body)))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestRecordMentions(t *testing.T) {
+	savedConf, savedClients, savedAccounts, savedMentions, savedMarkers := config, clients.list, accounts.list, mentions.list, markers.list
+	defer func() {
+		config, clients.list, accounts.list, mentions.list, markers.list = savedConf, savedClients, savedAccounts, savedMentions, savedMarkers
+	}()
+	config.DataDir = ""
+	accounts.list = map[string]account{"alice": {Nick: "Alice"}, "dave": {Nick: "dave"}, "erin": {Nick: "erin"}}
+	// dave had joined the lobby and the ops room, erin never did
+	markers.list = map[string]map[string]int64{"dave": {"lobby": 1, "ops": 1}}
+	mentions.dirty = false
+	clients.list = map[string]client{
+		"alice": {Nick: "Alice"},
+		"bob":   {Nick: "bob"},
+		"carol": {Nick: "carol"},
+	}
+	mentions.list = map[string][]mirc.HistoryMessage{}
+	r := room{Name: "Lobby", Members: []string{"Alice", "bob"}}
+	m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "lobby", "@alice @bob @carol @dave look")
+	m.Header.Sender = "bob"
+	m.Header.ID = 7
+	recordMentions(m, r)
+	if inbox := mentions.inbox("ALICE"); len(inbox) != 1 || inbox[0].Room != "Lobby" || inbox[0].ID != 7 {
+		t.Errorf("unexpected inbox of alice %+v", inbox)
+	}
+	if !mentions.dirty {
+		t.Error("mention of a registered nick not marked for saving")
+	}
+	if err := mentions.flush(); err != nil || mentions.dirty {
+		t.Errorf("mentions not flushed: %v", err)
+	}
+	if len(mentions.inbox("bob")) != 0 {
+		t.Error("sender got its own mention")
+	}
+	if len(mentions.inbox("carol")) != 0 || len(mentions.inbox("dave")) != 0 {
+		t.Error("mention recorded for a nick outside the room")
+	}
+	r.Modes = "P"
+	m.Body = "@dave @erin look"
+	m.Header.ID = 8
+	recordMentions(m, r)
+	if len(mentions.inbox("dave")) != 1 {
+		t.Error("offline registered nick missed a mention in a permanent room")
+	}
+	if len(mentions.inbox("erin")) != 0 {
+		t.Error("mention recorded for a registered nick that never joined")
+	}
+	secret := room{Name: "ops", Members: []string{"bob"}, Modes: "Ps"}
+	m = mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "ops", "@dave @erin the password is hunter2")
+	m.Header.Sender = "bob"
+	m.Header.ID = 9
+	recordMentions(m, secret)
+	if len(mentions.inbox("dave")) != 1 || len(mentions.inbox("erin")) != 0 {
+		t.Error("message of a secret room leaked to a registered non-member")
+	}
+	mentions.clear("dave")
+	mentions.retract("lobby", 7)
+	if len(mentions.inbox("alice")) != 0 || !mentions.dirty {
+		t.Error("deleted message is still in the inbox")
+	}
+}
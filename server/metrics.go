@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/******************** types ********************/
+// counterVec is a set of counters told apart by the value of one label
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]uint64
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	bounds  []float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// serverMetrics holds everything exported on /metrics
+type serverMetrics struct {
+	received    *counterVec
+	sent        *counterVec
+	writeErrors *counterVec
+	disconnects *counterVec
+	webhooks    *counterVec
+	fanout      *histogram
+
+	mu      sync.Mutex
+	reasons map[string]string
+}
+
+/********************* Globals ******************/
+
+// metrics collected since the server started
+var metrics = newServerMetrics()
+
+/********************** Metric funtions *****************/
+func newCounterVec(name string, help string, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: map[string]uint64{}}
+}
+
+func newHistogram(name string, help string, bounds []float64) *histogram {
+	return &histogram{name: name, help: help, bounds: bounds, buckets: make([]uint64, len(bounds))}
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		received:    newCounterVec("mirc_messages_received_total", "Messages received from clients.", "opcode"),
+		sent:        newCounterVec("mirc_messages_sent_total", "Messages sent to clients.", "opcode"),
+		writeErrors: newCounterVec("mirc_write_errors_total", "Messages that could not be written to a client.", "opcode"),
+		disconnects: newCounterVec("mirc_disconnects_total", "Client disconnections.", "reason"),
+		webhooks:    newCounterVec("mirc_webhook_deliveries_total", "Outgoing webhook deliveries.", "result"),
+		fanout: newHistogram("mirc_broadcast_fanout", "Number of receivers of a room broadcast.",
+			[]float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}),
+		reasons: map[string]string{},
+	}
+}
+
+// inc adds one to the counter with the given label value
+func (v *counterVec) inc(labelValue string) {
+	v.mu.Lock()
+	v.values[labelValue]++
+	v.mu.Unlock()
+}
+
+// write renders the counters in prometheus text format
+func (v *counterVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", v.name, v.label, k, v.values[k])
+	}
+}
+
+// observe records one value
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// write renders the histogram in prometheus text format
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bound := range h.bounds {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, le, h.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// writeGauge renders a single gauge in prometheus text format
+func writeGauge(w io.Writer, name string, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+// opLabel turns an opcode into a label value
+func opLabel(opCode int16) string {
+	return strconv.Itoa(int(opCode))
+}
+
+// setDisconnectReason remembers why a client is about to be disconnected,
+// the reason is counted once its request loop notices the closed socket
+func (s *serverMetrics) setDisconnectReason(nick string, reason string) {
+	s.mu.Lock()
+	s.reasons[nick] = reason
+	s.mu.Unlock()
+}
+
+// disconnected counts a disconnection, preferring a reason set earlier
+func (s *serverMetrics) disconnected(nick string, fallback string) {
+	s.mu.Lock()
+	reason, ok := s.reasons[nick]
+	delete(s.reasons, nick)
+	s.mu.Unlock()
+	if !ok {
+		reason = fallback
+	}
+	s.disconnects.inc(reason)
+}
+
+// metricsHandler serves all metrics in prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	connected := 0
+	clients.mu.Lock()
+	for _, c := range clients.list {
+		if c.Server == "" {
+			connected++
+		}
+	}
+	clients.mu.Unlock()
+	rooms.mu.Lock()
+	roomCount := len(rooms.list)
+	rooms.unlock()
+	writeGauge(w, "mirc_connected_clients", "Clients currently connected.", connected)
+	writeGauge(w, "mirc_rooms", "Rooms currently open.", roomCount)
+	writeGauge(w, "mirc_links", "Linked servers currently connected.", links.count())
+	metrics.received.write(w)
+	metrics.sent.write(w)
+	metrics.writeErrors.write(w)
+	metrics.disconnects.write(w)
+	metrics.webhooks.write(w)
+	metrics.fanout.write(w)
+}
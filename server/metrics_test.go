@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVecWrite(t *testing.T) {
+	v := newCounterVec("test_total", "A test counter.", "opcode")
+	v.inc("106")
+	v.inc("106")
+	v.inc("3")
+	var buf bytes.Buffer
+	v.write(&buf)
+	want := "# HELP test_total A test counter.\n" +
+		"# TYPE test_total counter\n" +
+		"test_total{opcode=\"106\"} 2\n" +
+		"test_total{opcode=\"3\"} 1\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram("test_fanout", "A test histogram.", []float64{1, 5, 10})
+	for _, v := range []float64{1, 3, 7, 20} {
+		h.observe(v)
+	}
+	var buf bytes.Buffer
+	h.write(&buf)
+	for _, line := range []string{
+		"test_fanout_bucket{le=\"1\"} 1",
+		"test_fanout_bucket{le=\"5\"} 2",
+		"test_fanout_bucket{le=\"10\"} 3",
+		"test_fanout_bucket{le=\"+Inf\"} 4",
+		"test_fanout_sum 31",
+		"test_fanout_count 4",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, buf.String())
+		}
+	}
+}
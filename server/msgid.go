@@ -0,0 +1,39 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// message ids are microseconds since the epoch, bumped when two messages
+// arrive in the same microsecond, shifted left to make room for a tag worked
+// out from the server name. They grow over time so they order messages, and
+// linked servers with different tags never make the same id.
+var msgIDs = struct {
+	mu   sync.Mutex
+	last int64
+}{}
+
+// bits of a message id that hold the server tag
+const msgIDTagBits = 10
+
+// msgIDTag returns the tag a server puts in the low bits of its message ids
+func msgIDTag(serverName string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(fold(serverName)))
+	return int64(h.Sum32() & (1<<msgIDTagBits - 1))
+}
+
+// nextMsgID returns a new message id
+func nextMsgID() int64 {
+	tag := msgIDTag(currentConfig().ServerName)
+	msgIDs.mu.Lock()
+	defer msgIDs.mu.Unlock()
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+	if now <= msgIDs.last {
+		now = msgIDs.last + 1
+	}
+	msgIDs.last = now
+	return now<<msgIDTagBits | tag
+}
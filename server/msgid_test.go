@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMsgIDs(t *testing.T) {
+	name := config.ServerName
+	defer func() { config.ServerName = name }()
+	config.ServerName = "alpha"
+	first := nextMsgID()
+	config.ServerName = "beta"
+	second := nextMsgID()
+	if second <= first {
+		t.Errorf("message ids don't grow: %d, %d", first, second)
+	}
+	if first&(1<<msgIDTagBits-1) != msgIDTag("alpha") || second&(1<<msgIDTagBits-1) != msgIDTag("beta") {
+		t.Errorf("message ids don't carry the server tag: %d, %d", first, second)
+	}
+	if msgIDTag("alpha") == msgIDTag("beta") || msgIDTag("Alpha") != msgIDTag("alpha") {
+		t.Error("unexpected server tags")
+	}
+}
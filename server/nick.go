@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/shaynewang/mirc"
+)
+
+/********************** Nick funtions *****************/
+// renameClient moves a nick to a new name in the client list and in the
+// member list of every room it is in, both lists are locked for the whole
+// change so nobody sees a half renamed client
+func renameClient(oldNick string, newNick string) error {
+	if err := mirc.ValidateNick(newNick); err != nil {
+		return err
+	}
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	clients.mu.Lock()
+	cl, ok := clients.list[fold(oldNick)]
+	if !ok {
+		clients.mu.Unlock()
+		return errors.New("no such nick " + oldNick)
+	}
+	// changing only the case of the own nick is allowed
+	if other, taken := clients.list[fold(newNick)]; taken && other.Nick != cl.Nick {
+		clients.mu.Unlock()
+		return errors.New("nickname exists")
+	}
+	oldNick = cl.Nick
+	delete(clients.list, fold(oldNick))
+	cl.Nick = newNick
+	clients.list[fold(newNick)] = cl
+	clients.mu.Unlock()
+	sessions.rename(oldNick, newNick)
+	markers.rename(oldNick, newNick)
+	mentions.rename(oldNick, newNick)
+	ignores.rename(oldNick, newNick)
+	shared := roomsOf(oldNick)
+	for _, name := range shared {
+		r := rooms.list[fold(name)]
+		r.Members[containFold(r.Members, oldNick)] = newNick
+		if i := containFold(r.Ops, oldNick); i >= 0 {
+			r.Ops[i] = newNick
+		}
+		rooms.list[fold(name)] = r
+	}
+	rename := newLinkMsg(mirc.SERVER_LINK_RENAME, oldNick, newNick)
+	rooms.post(func() { links.announce(rename, cl.Server) })
+	// nicks renamed on a linked server are announced by that server
+	if cl.Server == "" {
+		for _, name := range shared {
+			broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, name, oldNick+" is now known as "+newNick))
+		}
+	}
+	return nil
+}
+
+// changeNickHandler renames the client to the nick in the body
+func (c *client) changeNickHandler(m *mirc.Message) {
+	if m.Body == "" {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "please specify a nickname"))
+		return
+	}
+	// devices logged in to an account all serve the same nick
+	if accounts.registered(c.Nick) {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "registered nicknames cannot be changed"))
+		return
+	}
+	if accounts.registered(m.Body) {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "nickname is registered"))
+		return
+	}
+	oldNick := c.Nick
+	if err := renameClient(oldNick, m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.Nick = m.Body
+	c.send(newMsg(mirc.SERVER_RPL_NICK, c.Nick, "you are now known as "+c.Nick))
+	logInfo("nick changed", "nick", oldNick, "new", c.Nick)
+}
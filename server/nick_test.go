@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestRenameClient(t *testing.T) {
+	savedClients, savedRooms := clients.list, rooms.list
+	defer func() { clients.list, rooms.list = savedClients, savedRooms }()
+	server, peer := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, peer)
+	clients.list = map[string]client{
+		"alice": {Nick: "alice", Socket: &mirc.Connection{Conn: server}},
+		"bob":   {Nick: "bob", Socket: &mirc.Connection{Conn: server}},
+	}
+	rooms.list = map[string]room{
+		"public": {Name: "public", Members: []string{"server", "alice", "bob"}},
+		"go":     {Name: "go", Members: []string{"alice"}},
+	}
+	if err := renameClient("alice", "BOB"); err == nil {
+		t.Error("renamed to a nick that is taken")
+	}
+	if err := renameClient("alice", "bad nick"); err == nil {
+		t.Error("renamed to an invalid nick")
+	}
+	if err := renameClient("alice", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := clients.list["alice"]; ok {
+		t.Error("old nick is still in the client list")
+	}
+	if clients.list["carol"].Nick != "carol" {
+		t.Error("new nick is not in the client list")
+	}
+	for name, r := range rooms.list {
+		if contain(r.Members, "alice") >= 0 || contain(r.Members, "carol") < 0 {
+			t.Errorf("members of %s not renamed: %v", name, r.Members)
+		}
+	}
+	if err := renameClient("CAROL", "Carol"); err != nil {
+		t.Errorf("cannot change the case of the own nick: %v", err)
+	}
+	if clients.list["carol"].Nick != "Carol" {
+		t.Error("case change is not in the client list")
+	}
+	if err := renameClient("nobody", "dave"); err == nil {
+		t.Error("renamed a nick that doesn't exist")
+	}
+}
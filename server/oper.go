@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+
+	"github.com/shaynewang/mirc"
+)
+
+/********************** Operator funtions *****************/
+// checkOper reports whether name and password match an operator login
+func checkOper(name string, password string) bool {
+	for _, o := range currentConfig().Opers {
+		if o.Name == name && subtle.ConstantTimeCompare([]byte(o.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// isOper tells the client off if it's not an operator
+func (c *client) isOper() bool {
+	if !c.Oper {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "permission denied: you are not an operator"))
+		return false
+	}
+	return true
+}
+
+// disconnect closes the connection of a client, its request loop cleans up
+// the client list once the socket is closed. cause is the reason recorded in
+// the metrics and reason is the text shown to the client
+func disconnect(nick string, cause string, reason string) error {
+	clients.mu.Lock()
+	target, ok := clients.list[fold(nick)]
+	clients.mu.Unlock()
+	if !ok {
+		return errors.New("no such nick " + nick)
+	}
+	if target.Server != "" {
+		return errors.New(target.Nick + " is connected to " + target.Server)
+	}
+	sessions.drop(target.Nick)
+	if len(target.Devices) == 0 {
+		// detached, there is no request loop left to clean up
+		removeClient(target.Nick, clients.list)
+		target.disconnectHooks()
+		return nil
+	}
+	metrics.setDisconnectReason(target.Nick, cause)
+	target.send(newMsg(mirc.CONNECTION_CLOSED, target.Nick, reason))
+	for _, d := range target.Devices {
+		d.Conn.Close()
+	}
+	return nil
+}
+
+// partRoom removes a member from a room and lets the rest of the room know
+func partRoom(nick string, roomName string) error {
+	if fold(roomName) == "public" {
+		return errors.New("cannot leave public room")
+	}
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	r, ok := rooms.list[fold(roomName)]
+	if !ok {
+		return errors.New("room doesn't exist")
+	}
+	if err := r.removeMember(nick); err != nil {
+		return errors.New(nick + " is not a member of " + r.Name)
+	}
+	if len(r.Members) > 0 {
+		rooms.list[fold(roomName)] = r
+		broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, r.Name, nick+" left the room"))
+	} else if r.permanent() {
+		rooms.list[fold(roomName)] = r
+	}
+	return nil
+}
+
+// tell sends a server notice to a nick if it's connected
+func tell(nick string, body string) {
+	clients.mu.Lock()
+	target, ok := clients.list[fold(nick)]
+	clients.mu.Unlock()
+	if ok {
+		target.send(newMsg(mirc.SERVER_TELL_MESSAGE, target.Nick, body))
+	}
+}
+
+// operHandler grants operator privileges when the credentials are right
+// the message body holds "name password"
+func (c *client) operHandler(m *mirc.Message) {
+	args := strings.SplitN(m.Body, " ", 2)
+	if len(args) != 2 || !checkOper(args[0], args[1]) {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "invalid operator credentials"))
+		logWarn("failed operator login", "nick", c.Nick, "remote", c.IP)
+		return
+	}
+	c.Oper = true
+	clients.mu.Lock()
+	if cl, ok := clients.list[fold(c.Nick)]; ok {
+		cl.Oper = true
+		clients.list[fold(c.Nick)] = cl
+	}
+	clients.mu.Unlock()
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "you are now a server operator"))
+	logInfo("operator login", "nick", c.Nick, "oper", args[0], "remote", c.IP)
+}
+
+// killHandler force-disconnects the nick in the receiver field
+func (c *client) killHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	reason := "killed by " + c.Nick
+	if len(m.Body) > 0 {
+		reason += ": " + m.Body
+	}
+	if err := disconnect(m.Header.Receiver, "killed", reason); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, m.Header.Receiver+" has been disconnected"))
+	logInfo("client killed", "oper", c.Nick, "nick", m.Header.Receiver, "reason", m.Body)
+}
+
+// announce sends a message from sender to every connected client regardless
+// of room, clients on linked servers included
+func announce(sender string, body string) {
+	wall := newMsg(mirc.SERVER_WALL_MESSAGE, "*", body)
+	wall.Header.Sender = sender
+	// a slow connection must not hold up everyone waiting for the lock
+	clients.mu.Lock()
+	receivers := make([]client, 0, len(clients.list))
+	for _, cl := range clients.list {
+		receivers = append(receivers, cl)
+	}
+	clients.mu.Unlock()
+	for _, cl := range receivers {
+		cl.send(wall)
+	}
+}
+
+// wallHandler sends a message to every connected client regardless of room
+func (c *client) wallHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	announce(c.Nick, m.Body)
+}
+
+// deleteRoomHandler removes a room and tells its members
+func (c *client) deleteRoomHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	if fold(m.Body) == "public" {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "cannot delete public room"))
+		return
+	}
+	rooms.mu.Lock()
+	r, ok := rooms.list[fold(m.Body)]
+	if !ok {
+		rooms.unlock()
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "room "+m.Body+" doesn't exist."))
+		return
+	}
+	broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, m.Body, "this room has been deleted by "+c.Nick))
+	delete(rooms.list, fold(m.Body))
+	history.drop(m.Body)
+	if r.permanent() {
+		if err := saveRooms(); err != nil {
+			logError("cannot save permanent rooms", "err", err)
+		}
+	}
+	var members []client
+	clients.mu.Lock()
+	for _, nick := range r.Members {
+		if member, ok := clients.list[fold(nick)]; ok {
+			members = append(members, member)
+		}
+	}
+	clients.mu.Unlock()
+	rooms.unlock()
+	for _, member := range members {
+		member.leaveHooks(r.Name)
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "room "+m.Body+" deleted"))
+	logInfo("room deleted", "oper", c.Nick, "room", m.Body)
+}
+
+// forceJoinHandler adds the nick in the receiver field to the room in the body
+func (c *client) forceJoinHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	clients.mu.Lock()
+	target, ok := clients.list[fold(m.Header.Receiver)]
+	clients.mu.Unlock()
+	if !ok {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "no such nick "+m.Header.Receiver))
+		return
+	}
+	if err := target.joinRoom(m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	tell(target.Nick, c.Nick+" has joined you to "+m.Body)
+	if target.Server == "" {
+		target.sendMarker(m.Body)
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, target.Nick+" joined to "+m.Body))
+}
+
+// forcePartHandler removes the nick in the receiver field from the room in the body
+func (c *client) forcePartHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	if err := partRoom(m.Header.Receiver, m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	clients.mu.Lock()
+	target, ok := clients.list[fold(m.Header.Receiver)]
+	clients.mu.Unlock()
+	if ok && target.Server == "" {
+		target.leaveHooks(m.Body)
+	}
+	tell(m.Header.Receiver, c.Nick+" has removed you from "+m.Body)
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, m.Header.Receiver+" removed from "+m.Body))
+}
+
+// banHandler bans an address or range and drops matching clients
+func (c *client) banHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	if err := bans.add(m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	var banned []string
+	clients.mu.Lock()
+	for _, cl := range clients.list {
+		if cl.Server == "" && bans.match(remoteIP(cl.IP)) {
+			banned = append(banned, cl.Nick)
+		}
+	}
+	clients.mu.Unlock()
+	for _, nick := range banned {
+		disconnect(nick, "banned", "you are banned from this server")
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, m.Body+" banned"))
+	logInfo("ban added", "oper", c.Nick, "ban", m.Body, "disconnected", len(banned))
+}
+
+// unbanHandler lifts a ban
+func (c *client) unbanHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	if err := bans.remove(m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, m.Body+" unbanned"))
+	logInfo("ban removed", "oper", c.Nick, "ban", m.Body)
+}
+
+// listBansHandler replies with all ban entries
+func (c *client) listBansHandler() {
+	if !c.isOper() {
+		return
+	}
+	msgBody := strings.Join(bans.list(), " ,")
+	c.send(newMsg(mirc.SERVER_RPL_LIST_BANS, c.Nick, msgBody))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// testClient connects a client over a pipe from addr, the messages it gets
+// arrive on the channel
+func testClient(nick string, addr string) (client, chan *mirc.Message) {
+	server, peer := net.Pipe()
+	conn := &mirc.Connection{Conn: server}
+	received := make(chan *mirc.Message, 100)
+	go func() {
+		in := &mirc.Connection{Conn: peer}
+		for {
+			opCode, m := in.GetMsg()
+			if opCode == mirc.ERROR {
+				close(received)
+				return
+			}
+			received <- m
+		}
+	}()
+	ip, _ := net.ResolveTCPAddr("tcp", addr)
+	c := client{Nick: nick, IP: ip, Socket: conn, Devices: []*mirc.Connection{conn}}
+	return c, received
+}
+
+// expectMsg waits for a message with opCode on a test client
+func expectMsg(t *testing.T, received chan *mirc.Message, opCode int16) *mirc.Message {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m, ok := <-received:
+			if !ok {
+				t.Fatalf("connection closed while waiting for opcode %d", opCode)
+			}
+			if m.Header.OpCode == opCode {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("no message with opcode %d", opCode)
+		}
+	}
+}
+
+func TestOperCommands(t *testing.T) {
+	savedConf, savedClients, savedRooms := config, clients.list, rooms.list
+	defer func() { config, clients.list, rooms.list = savedConf, savedClients, savedRooms }()
+	config.DataDir = ""
+	config.Opers = []operConf{{Name: "admin", Password: "secret"}}
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	bob, bobMsgs := testClient("bob", "10.0.0.2:5000")
+	carol, carolMsgs := testClient("carol", "192.168.1.1:5000")
+	clients.list = map[string]client{"alice": alice, "bob": bob, "carol": carol}
+	rooms.list = map[string]room{
+		"public": {Name: "public", Members: []string{"server", "alice", "bob", "carol"}},
+		"team":   {Name: "team", Members: []string{"bob"}},
+	}
+
+	bob.wallHandler(mirc.NewMsg(mirc.CLIENT_WALL, "", "hi"))
+	if m := expectMsg(t, bobMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "permission denied: you are not an operator" {
+		t.Errorf("unexpected reply to a client who isn't an operator: %q", m.Body)
+	}
+	alice.operHandler(mirc.NewMsg(mirc.CLIENT_OPER, "", "admin wrong"))
+	if alice.Oper || clients.list["alice"].Oper {
+		t.Fatal("operator login with a wrong password")
+	}
+	expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE)
+	alice.operHandler(mirc.NewMsg(mirc.CLIENT_OPER, "", "admin secret"))
+	if !alice.Oper || !clients.list["alice"].Oper {
+		t.Fatal("operator login failed")
+	}
+	expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE)
+
+	alice.wallHandler(mirc.NewMsg(mirc.CLIENT_WALL, "", "maintenance"))
+	for _, received := range []chan *mirc.Message{aliceMsgs, bobMsgs, carolMsgs} {
+		if m := expectMsg(t, received, mirc.SERVER_WALL_MESSAGE); m.Header.Sender != "alice" || m.Body != "maintenance" {
+			t.Errorf("unexpected wall %+v", m)
+		}
+	}
+
+	alice.deleteRoomHandler(mirc.NewMsg(mirc.CLIENT_DELETE_ROOM, "", "Team"))
+	if _, ok := rooms.list["team"]; ok {
+		t.Error("room was not deleted")
+	}
+	expectMsg(t, bobMsgs, mirc.SERVER_BROADCAST_MESSAGE)
+	alice.deleteRoomHandler(mirc.NewMsg(mirc.CLIENT_DELETE_ROOM, "", "public"))
+	if _, ok := rooms.list["public"]; !ok {
+		t.Error("public room was deleted")
+	}
+
+	alice.killHandler(mirc.NewMsg(mirc.CLIENT_KILL, "bob", "spam"))
+	if m := expectMsg(t, bobMsgs, mirc.CONNECTION_CLOSED); m.Body != "killed by alice: spam" {
+		t.Errorf("unexpected kill reason %q", m.Body)
+	}
+
+	savedBans := bans.list()
+	defer func() {
+		bans.entries, bans.nets = nil, nil
+		for _, entry := range savedBans {
+			bans.add(entry)
+		}
+	}()
+	alice.banHandler(mirc.NewMsg(mirc.CLIENT_BAN, "", "192.168.0.0/16"))
+	if !bans.match(net.ParseIP("192.168.1.1")) {
+		t.Error("range was not banned")
+	}
+	if m := expectMsg(t, carolMsgs, mirc.CONNECTION_CLOSED); m.Body != "you are banned from this server" {
+		t.Errorf("unexpected ban reason %q", m.Body)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// how often idle clients are checked for auto-away
+const autoAwayInterval = 30
+
+/********************** Presence funtions *****************/
+// setAway marks a nick away with a message, an empty message marks it back
+// auto tells whether the server set the status because the client was idle
+func setAway(nick string, message string, auto bool) bool {
+	clients.mu.Lock()
+	cl, ok := clients.list[fold(nick)]
+	if ok {
+		cl.Away = message
+		cl.AutoAway = auto && message != ""
+		clients.list[fold(nick)] = cl
+	}
+	clients.mu.Unlock()
+	if ok {
+		links.announce(newLinkMsg(mirc.SERVER_LINK_AWAY, nick, message), cl.Server)
+	}
+	return ok
+}
+
+// awayStatus returns the away message of a nick, empty if it's not away
+func awayStatus(nick string) string {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	return clients.list[fold(nick)].Away
+}
+
+// memberNames decorates the members of a room with their away status,
+// assumes rooms lock is held
+func memberNames(members []string) []string {
+	names := make([]string, 0, len(members))
+	clients.mu.Lock()
+	for _, nick := range members {
+		if clients.list[fold(nick)].Away != "" {
+			nick += " (away)"
+		}
+		names = append(names, nick)
+	}
+	clients.mu.Unlock()
+	return names
+}
+
+// awayHandler sets or clears the away status of the client
+func (c *client) awayHandler(m *mirc.Message) {
+	setAway(c.Nick, m.Body, false)
+	if m.Body == "" {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "you are no longer marked as away"))
+	} else {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "you have been marked as away: "+m.Body))
+	}
+	logDebug("away status changed", "nick", c.Nick, "away", m.Body)
+}
+
+// awayReply tells the sender of a private message that the receiver is away
+func awayReply(m *mirc.Message) {
+	if away := awayStatus(m.Header.Receiver); away != "" {
+		tell(m.Header.Sender, m.Header.Receiver+" is away: "+away)
+	}
+}
+
+// markIdle marks local clients away that have made no request since a time
+func markIdle(idleSince time.Time) {
+	var idle []string
+	clients.mu.Lock()
+	for _, cl := range clients.list {
+		if cl.Server == "" && cl.Away == "" && cl.LastActive.Before(idleSince) {
+			idle = append(idle, cl.Nick)
+		}
+	}
+	clients.mu.Unlock()
+	for _, nick := range idle {
+		setAway(nick, "idle", true)
+		tell(nick, "you have been marked as away after being idle")
+	}
+}
+
+// autoAwayLoop marks local clients away once they have been idle for the
+// configured number of seconds
+func autoAwayLoop() {
+	for {
+		time.Sleep(autoAwayInterval * time.Second)
+		if autoAway := currentConfig().AutoAway; autoAway > 0 {
+			markIdle(time.Now().Add(-time.Duration(autoAway) * time.Second))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestPresence(t *testing.T) {
+	savedClients := clients.list
+	defer func() { clients.list = savedClients }()
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	bob, _ := testClient("bob", "10.0.0.2:5000")
+	alice.LastActive = time.Now().Add(-time.Hour)
+	bob.LastActive = time.Now()
+	clients.list = map[string]client{"alice": alice, "bob": bob}
+
+	markIdle(time.Now().Add(-time.Minute))
+	if !clients.list["alice"].AutoAway || awayStatus("alice") != "idle" {
+		t.Error("idle client was not marked away")
+	}
+	if awayStatus("bob") != "" {
+		t.Error("active client was marked away")
+	}
+	expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE)
+
+	// setting an away message while auto-away doesn't mark the client back first
+	alice.touch(mirc.CLIENT_AWAY)
+	alice.awayHandler(mirc.NewMsg(mirc.CLIENT_AWAY, "", "lunch"))
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "you have been marked as away: lunch" {
+		t.Errorf("unexpected reply %q", m.Body)
+	}
+	if cl := clients.list["alice"]; cl.Away != "lunch" || cl.AutoAway {
+		t.Errorf("unexpected away status %+v", cl)
+	}
+	alice.touch(mirc.CLIENT_SEND_PUB_MESSAGE)
+	if awayStatus("alice") != "lunch" {
+		t.Error("activity cleared an away status the client set")
+	}
+
+	alice.awayHandler(mirc.NewMsg(mirc.CLIENT_AWAY, "", ""))
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "you are no longer marked as away" {
+		t.Errorf("unexpected reply %q", m.Body)
+	}
+	if awayStatus("alice") != "" {
+		t.Error("client still away after coming back")
+	}
+
+	markIdle(time.Now().Add(time.Minute))
+	expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE)
+	alice.touch(mirc.CLIENT_SEND_PUB_MESSAGE)
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "you are no longer marked as away" || awayStatus("alice") != "" {
+		t.Errorf("activity didn't end the automatic away status: %q", m.Body)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Rooms have a topic and modes. A secret room (+s) only shows up in the
+// room list and in whois for its members and operators, a room with +t only
+// lets its operators change the topic. A permanent room (+P) stays when its
+// last member leaves, only server operators set it and permanent rooms are
+// persisted without their members.
+
+// rooms per page of the room list
+const roomPageSize = 20
+
+// modes a room can have
+const roomModes = "stP"
+
+const roomFile = "rooms.json"
+
+/******************** types ********************/
+// roomQuery is a parsed room list request
+type roomQuery struct {
+	match func(name string) bool
+	sort  string
+	page  int
+}
+
+// savedRoom is a permanent room as it is persisted
+type savedRoom struct {
+	Name    string    `json:"name"`
+	Topic   string    `json:"topic,omitempty"`
+	Modes   string    `json:"modes"`
+	Ops     []string  `json:"ops,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+/********************** Room funtions *****************/
+// hasMode reports whether a room has a mode set
+func (r *room) hasMode(mode rune) bool {
+	return strings.ContainsRune(r.Modes, mode)
+}
+
+// visibleTo reports whether a client may see a room in lists
+func (r *room) visibleTo(c *client) bool {
+	return !r.hasMode('s') || c.Oper || containFold(r.Members, c.Nick) >= 0
+}
+
+// permanent reports whether a room stays when it is empty
+func (r *room) permanent() bool {
+	return r.hasMode('P')
+}
+
+// isRoomOp reports whether the client may manage a room, assumes rooms lock
+// is held
+func (c *client) isRoomOp(r room) bool {
+	return c.Oper || containFold(r.Ops, c.Nick) >= 0
+}
+
+// parseRoomQuery reads a room list request: an optional glob pattern or a
+// /regexp/, and the options sort:name|members|created and page:n
+func parseRoomQuery(text string) (roomQuery, error) {
+	q := roomQuery{match: func(string) bool { return true }, sort: "name", page: 1}
+	for _, field := range strings.Fields(text) {
+		if strings.HasPrefix(field, "sort:") {
+			q.sort = strings.TrimPrefix(field, "sort:")
+			if q.sort != "name" && q.sort != "members" && q.sort != "created" {
+				return q, errors.New("rooms can be sorted by name, members or created")
+			}
+		} else if strings.HasPrefix(field, "page:") {
+			page, err := strconv.Atoi(strings.TrimPrefix(field, "page:"))
+			if err != nil || page < 1 {
+				return q, errors.New("invalid page " + field)
+			}
+			q.page = page
+		} else if len(field) > 2 && strings.HasPrefix(field, "/") && strings.HasSuffix(field, "/") {
+			re, err := regexp.Compile("(?i)" + field[1:len(field)-1])
+			if err != nil {
+				return q, errors.New("invalid pattern " + field)
+			}
+			q.match = re.MatchString
+		} else {
+			pattern := fold(field)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return q, errors.New("invalid pattern " + field)
+			}
+			q.match = func(name string) bool {
+				ok, _ := path.Match(pattern, fold(name))
+				return ok
+			}
+		}
+	}
+	return q, nil
+}
+
+// listRooms returns the requested page of the rooms the client can see
+func (c *client) listRooms(q roomQuery) mirc.RoomList {
+	infos := []mirc.RoomInfo{}
+	rooms.mu.Lock()
+	for _, r := range rooms.list {
+		if r.visibleTo(c) && q.match(r.Name) {
+			infos = append(infos, roomInfo(r, false))
+		}
+	}
+	rooms.unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		if q.sort == "members" && infos[i].MemberCount != infos[j].MemberCount {
+			return infos[i].MemberCount > infos[j].MemberCount
+		}
+		if q.sort == "created" && !infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].Created.After(infos[j].Created)
+		}
+		return fold(infos[i].Name) < fold(infos[j].Name)
+	})
+	list := mirc.RoomList{
+		Page:  q.page,
+		Pages: (len(infos) + roomPageSize - 1) / roomPageSize,
+		Total: len(infos),
+		Rooms: []mirc.RoomInfo{},
+	}
+	start := (q.page - 1) * roomPageSize
+	if start < len(infos) {
+		end := start + roomPageSize
+		if end > len(infos) {
+			end = len(infos)
+		}
+		list.Rooms = infos[start:end]
+	}
+	return list
+}
+
+// setTopic changes the topic of a room and tells its members
+func (c *client) setTopic(roomName string, topic string) error {
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	r, ok := rooms.list[fold(roomName)]
+	if !ok || !r.visibleTo(c) {
+		return errors.New("room " + roomName + " doesn't exist")
+	}
+	if containFold(r.Members, c.Nick) < 0 && !c.Oper {
+		return errors.New("not a member of the room")
+	}
+	if r.hasMode('t') && !c.isRoomOp(r) {
+		return errors.New("permission denied: only room operators can change the topic")
+	}
+	r.Topic = topic
+	rooms.list[fold(r.Name)] = r
+	broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, r.Name, c.Nick+" changed the topic to: "+topic))
+	if r.permanent() {
+		return saveRooms()
+	}
+	return nil
+}
+
+// setModes applies mode changes like "+s" or "-t" to a room
+func (c *client) setModes(roomName string, change string) (string, error) {
+	if len(change) < 2 || (change[0] != '+' && change[0] != '-') {
+		return "", errors.New("modes look like +s or -t")
+	}
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	r, ok := rooms.list[fold(roomName)]
+	if !ok || !r.visibleTo(c) {
+		return "", errors.New("room " + roomName + " doesn't exist")
+	}
+	if !c.isRoomOp(r) {
+		return "", errors.New("permission denied: only room operators can change modes")
+	}
+	permanent := r.permanent()
+	for _, mode := range change[1:] {
+		if !strings.ContainsRune(roomModes, mode) {
+			return "", errors.New("unknown room mode " + string(mode))
+		}
+		if mode == 'P' && !c.Oper {
+			return "", errors.New("permission denied: only server operators can make a room permanent")
+		}
+		r.Modes = strings.Replace(r.Modes, string(mode), "", -1)
+		if change[0] == '+' {
+			r.Modes += string(mode)
+		}
+	}
+	if len(r.Members) == 0 && !r.permanent() {
+		// nobody left to keep it
+		delete(rooms.list, fold(r.Name))
+		history.drop(r.Name)
+	} else {
+		rooms.list[fold(r.Name)] = r
+		broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, r.Name, c.Nick+" set mode "+change))
+	}
+	if permanent || r.permanent() {
+		return r.Modes, saveRooms()
+	}
+	return r.Modes, nil
+}
+
+// keepRooms makes rooms permanent, creating the missing ones empty. Rooms
+// are never made temporary here, +P set by an operator looks the same
+func keepRooms(names []string) error {
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	changed := false
+	for _, name := range names {
+		if err := mirc.ValidateRoom(name); err != nil {
+			return err
+		}
+		r, ok := rooms.list[fold(name)]
+		if !ok {
+			r = room{Name: name, Created: time.Now()}
+		}
+		if !r.permanent() {
+			r.Modes += "P"
+			rooms.list[fold(r.Name)] = r
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveRooms()
+}
+
+// autoJoin adds a new client to the rooms of the configuration that exist
+func autoJoin(nick string) {
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	for _, name := range currentConfig().AutoJoin {
+		if r, ok := rooms.list[fold(name)]; ok && r.addMember(nick) == nil {
+			rooms.list[fold(r.Name)] = r
+			logInfo("room joined", "nick", nick, "room", r.Name)
+		}
+	}
+}
+
+// saveRooms persists the permanent rooms, assumes rooms lock is held
+func saveRooms() error {
+	saved := []savedRoom{}
+	for _, r := range rooms.list {
+		if r.permanent() {
+			saved = append(saved, savedRoom{Name: r.Name, Topic: r.Topic, Modes: r.Modes, Ops: r.Ops, Created: r.Created})
+		}
+	}
+	return saveState(roomFile, saved)
+}
+
+// loadRooms reads the persisted permanent rooms
+func loadRooms() error {
+	var saved []savedRoom
+	if err := loadState(roomFile, &saved); err != nil {
+		return err
+	}
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	for _, r := range saved {
+		if _, ok := rooms.list[fold(r.Name)]; !ok {
+			rooms.list[fold(r.Name)] = room{Name: r.Name, Topic: r.Topic, Modes: r.Modes, Ops: r.Ops, Created: r.Created}
+		}
+	}
+	return nil
+}
+
+// topicHandler sets the topic of the room in the receiver field to the body
+func (c *client) topicHandler(m *mirc.Message) {
+	if err := c.setTopic(m.Header.Receiver, m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	logInfo("topic changed", "nick", c.Nick, "room", m.Header.Receiver)
+}
+
+// modeHandler changes the modes of the room in the receiver field, the body
+// holds the change
+func (c *client) modeHandler(m *mirc.Message) {
+	modes, err := c.setModes(m.Header.Receiver, m.Body)
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	logInfo("room modes changed", "nick", c.Nick, "room", m.Header.Receiver, "modes", modes)
+}
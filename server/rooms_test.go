@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestListRooms(t *testing.T) {
+	savedRooms := rooms.list
+	defer func() { rooms.list = savedRooms }()
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 12, 0, 0, 0, time.Local) }
+	rooms.list = map[string]room{
+		"public":   {Name: "public", Members: []string{"server", "alice", "bob"}, Created: day(1)},
+		"golang":   {Name: "Golang", Members: []string{"alice"}, Created: day(3)},
+		"gophers":  {Name: "gophers", Members: []string{"bob"}, Created: day(2), Modes: "s"},
+		"rustlang": {Name: "rustlang", Members: []string{"carol"}, Created: day(4), Ops: []string{"carol"}},
+	}
+	list := func(c *client, text string) []string {
+		q, err := parseRoomQuery(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range c.listRooms(q).Rooms {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+	alice := &client{Nick: "alice"}
+	if names := list(alice, ""); len(names) != 3 || names[0] != "Golang" {
+		t.Errorf("unexpected rooms %v", names)
+	}
+	if names := list(&client{Nick: "Bob"}, "go*"); len(names) != 2 || names[1] != "gophers" {
+		t.Errorf("member doesn't see the secret room: %v", names)
+	}
+	if names := list(&client{Nick: "root", Oper: true}, "/^GO/"); len(names) != 2 {
+		t.Errorf("operator doesn't see the secret room: %v", names)
+	}
+	if names := list(alice, "*lang sort:created"); len(names) != 2 || names[0] != "rustlang" {
+		t.Errorf("unexpected order %v", names)
+	}
+	if names := list(alice, "sort:members"); names[0] != "public" {
+		t.Errorf("unexpected order %v", names)
+	}
+	if names := list(alice, "page:2"); len(names) != 0 {
+		t.Errorf("unexpected second page %v", names)
+	}
+	for _, text := range []string{"sort:size", "page:0", "/(/", "[a"} {
+		if _, err := parseRoomQuery(text); err == nil {
+			t.Errorf("invalid query %q accepted", text)
+		}
+	}
+	if _, err := alice.setModes("rustlang", "+s"); err == nil {
+		t.Error("a member who isn't a room operator changed modes")
+	}
+	if _, err := alice.setModes("gophers", "+t"); err == nil {
+		t.Error("changed modes of a secret room the client can't see")
+	}
+	if _, err := (&client{Nick: "carol"}).setModes("rustlang", "+x"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestAPIHidesSecretRooms(t *testing.T) {
+	savedClients, savedRooms := clients.list, rooms.list
+	defer func() { clients.list, rooms.list = savedClients, savedRooms }()
+	clients.list = map[string]client{"bob": {Nick: "bob"}}
+	rooms.list = map[string]room{
+		"public":  {Name: "public", Members: []string{"server", "bob"}},
+		"gophers": {Name: "gophers", Members: []string{"bob"}, Modes: "s"},
+	}
+	get := func(handler http.HandlerFunc, path string, v interface{}) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if v != nil {
+			json.NewDecoder(w.Body).Decode(v)
+		}
+		return w.Code
+	}
+	var list []mirc.RoomInfo
+	get(roomsHandler, "/rooms", &list)
+	if len(list) != 1 || list[0].Name != "public" {
+		t.Errorf("unexpected rooms %+v", list)
+	}
+	if code := get(roomHandler, "/rooms/gophers", nil); code != http.StatusNotFound {
+		t.Errorf("secret room answered with %d", code)
+	}
+	var infos []mirc.ClientInfo
+	get(clientsHandler, "/clients", &infos)
+	if len(infos) != 1 || len(infos[0].Rooms) != 1 {
+		t.Errorf("secret room listed with its members: %+v", infos)
+	}
+}
+
+func TestPermanentRooms(t *testing.T) {
+	savedConf, savedRooms := config, rooms.list
+	defer func() { config, rooms.list = savedConf, savedRooms }()
+	config.DataDir = ""
+	rooms.list = map[string]room{
+		"team": {Name: "Team", Members: []string{"alice"}, Ops: []string{"alice"}},
+	}
+	if err := keepRooms([]string{"team", "lobby"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keepRooms([]string{"bad room"}); err == nil {
+		t.Error("invalid room name made permanent")
+	}
+	if r := rooms.list["lobby"]; !r.permanent() || len(r.Members) != 0 {
+		t.Errorf("permanent room not created empty: %+v", r)
+	}
+	if err := partRoom("alice", "team"); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rooms.list["team"]; !ok || !r.permanent() || len(r.Members) != 0 {
+		t.Error("permanent room removed when its last member left")
+	}
+	if _, err := (&client{Nick: "alice"}).setModes("team", "-P"); err == nil {
+		t.Error("a room operator who isn't a server operator changed a permanent room")
+	}
+	if _, err := (&client{Nick: "root", Oper: true}).setModes("lobby", "-P"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rooms.list["lobby"]; ok {
+		t.Error("empty room kept after it stopped being permanent")
+	}
+}
+
+func TestSecretRoomLookups(t *testing.T) {
+	savedRooms := rooms.list
+	defer func() { rooms.list = savedRooms }()
+	rooms.list = map[string]room{
+		"gophers": {Name: "gophers", Members: []string{"bob"}, Modes: "s"},
+	}
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	bob, bobMsgs := testClient("bob", "10.0.0.2:5000")
+	alice.listMemberHandler("gophers")
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "room gophers doesn't exist.\n" {
+		t.Errorf("members of a secret room listed to a non-member: %q", m.Body)
+	}
+	alice.inRoomHandler("gophers")
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "room gophers doesn't exist.\n" {
+		t.Errorf("secret room revealed to a non-member: %q", m.Body)
+	}
+	bob.listMemberHandler("gophers")
+	if m := expectMsg(t, bobMsgs, mirc.SERVER_RPL_LIST_MEMBER); m.Body != "bob" {
+		t.Errorf("unexpected members %q", m.Body)
+	}
+	bob.inRoomHandler("gophers")
+	expectMsg(t, bobMsgs, mirc.SERVER_RPL_CLIENT_IN_ROOM)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Scheduled messages go to a room, or to every client when the room is "*",
+// at a time of day on some days of the week ("daily 09:55", "weekdays 09:55",
+// "mon,thu 14:00") or at an interval ("every 30m"). Schedules come from the
+// configuration file or are created by operators at runtime; those are
+// persisted. Runs missed while the server is down are skipped.
+
+const scheduleFile = "schedules.json"
+
+// seconds between checks for due schedules
+const scheduleInterval = 1
+
+// shortest interval of an "every" schedule
+const minScheduleEvery = time.Minute
+
+/******************** types ********************/
+// recurrence is a parsed schedule, either an interval or a time of day on
+// some weekdays
+type recurrence struct {
+	every  time.Duration
+	days   [7]bool
+	hour   int
+	minute int
+}
+
+// scheduledJob is a message sent on a schedule
+type scheduledJob struct {
+	ID      int    `json:"id"`
+	Room    string `json:"room"`
+	When    string `json:"when"`
+	Body    string `json:"body"`
+	Sender  string `json:"sender"`
+	Creator string `json:"creator"`
+	rec     recurrence
+	next    time.Time
+}
+type scheduleList struct {
+	mu     sync.Mutex
+	lastID int
+	// jobs created at runtime by id
+	list map[int]*scheduledJob
+	// jobs from the configuration file
+	conf []*scheduledJob
+}
+
+/********************* Globals ******************/
+
+// scheduled messages
+var schedules = scheduleList{
+	mu:   sync.Mutex{},
+	list: map[int]*scheduledJob{},
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+/********************** Schedule funtions *****************/
+// parseWhen reads a schedule: "every <duration>", or "daily", "weekdays",
+// "weekends" or a list of days like "mon,wed" followed by the time "hh:mm"
+func parseWhen(when string) (recurrence, error) {
+	var rec recurrence
+	args := strings.Fields(strings.ToLower(when))
+	if len(args) != 2 {
+		return rec, errors.New("schedules look like \"daily 09:55\", \"mon,thu 14:00\" or \"every 30m\"")
+	}
+	if args[0] == "every" {
+		every, err := time.ParseDuration(args[1])
+		if err != nil || every < minScheduleEvery {
+			return rec, errors.New("invalid interval " + args[1] + ", it must be at least 1m")
+		}
+		rec.every = every
+		return rec, nil
+	}
+	if args[0] == "daily" {
+		args[0] = "sun,mon,tue,wed,thu,fri,sat"
+	} else if args[0] == "weekdays" {
+		args[0] = "mon,tue,wed,thu,fri"
+	} else if args[0] == "weekends" {
+		args[0] = "sat,sun"
+	}
+	for _, name := range strings.Split(args[0], ",") {
+		day, ok := weekdays[name]
+		if !ok {
+			return rec, errors.New("unknown day " + name)
+		}
+		rec.days[day] = true
+	}
+	at, err := time.Parse("15:04", args[1])
+	if err != nil {
+		return rec, errors.New("invalid time " + args[1] + ", use hh:mm")
+	}
+	rec.hour, rec.minute = at.Hour(), at.Minute()
+	return rec, nil
+}
+
+// next returns the first run of a schedule after a time
+func (rec recurrence) next(after time.Time) time.Time {
+	if rec.every > 0 {
+		return after.Add(rec.every)
+	}
+	for d := 0; d <= 7; d++ {
+		run := time.Date(after.Year(), after.Month(), after.Day()+d, rec.hour, rec.minute, 0, 0, after.Location())
+		if run.After(after) && rec.days[run.Weekday()] {
+			return run
+		}
+	}
+	// no days set, parseWhen never returns such a schedule
+	return after.AddDate(1, 0, 0)
+}
+
+// newJob checks a schedule and works out its first run
+func newJob(roomName string, when string, body string, sender string) (*scheduledJob, error) {
+	rec, err := parseWhen(when)
+	if err != nil {
+		return nil, err
+	}
+	if roomName == "" || strings.TrimSpace(body) == "" {
+		return nil, errors.New("a schedule needs a room, or * for everyone, and a message")
+	}
+	return &scheduledJob{
+		Room:   roomName,
+		When:   when,
+		Body:   body,
+		Sender: sender,
+		rec:    rec,
+		next:   rec.next(time.Now()),
+	}, nil
+}
+
+// describe returns a line about the job for listings
+func (j *scheduledJob) describe() string {
+	return j.Room + " " + j.When + " as " + j.Sender + ": " + j.Body + " (next " + j.next.Format("Mon Jan 2 15:04") + ")"
+}
+
+// fire sends the message of a job
+func (j *scheduledJob) fire() {
+	if j.Room == "*" {
+		announce(j.Sender, j.Body)
+	} else if err := sayInRoom(j.Room, j.Sender, j.Body); err != nil {
+		logWarn("cannot send scheduled message", "room", j.Room, "err", err)
+		return
+	}
+	logDebug("scheduled message sent", "room", j.Room, "when", j.When)
+}
+
+// configure replaces the jobs from the configuration file, jobs without a
+// sender are sent as serverName
+func (l *scheduleList) configure(confs []scheduleConf, serverName string) error {
+	var jobs []*scheduledJob
+	for _, sc := range confs {
+		if sc.Sender == "" {
+			sc.Sender = serverName
+		}
+		j, err := newJob(sc.Room, sc.When, sc.Body, sc.Sender)
+		if err != nil {
+			return errors.New("schedule for " + sc.Room + ": " + err.Error())
+		}
+		jobs = append(jobs, j)
+	}
+	l.mu.Lock()
+	l.conf = jobs
+	l.mu.Unlock()
+	return nil
+}
+
+// add creates a runtime job and persists the list
+func (l *scheduleList) add(j *scheduledJob) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastID++
+	j.ID = l.lastID
+	l.list[j.ID] = j
+	return l.save()
+}
+
+// remove deletes a runtime job and persists the list
+func (l *scheduleList) remove(id int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.list[id]; !ok {
+		return errors.New("no such schedule #" + strconv.Itoa(id))
+	}
+	delete(l.list, id)
+	return l.save()
+}
+
+// due returns the jobs to run at now and moves them to their next run
+func (l *scheduleList) due(now time.Time) []scheduledJob {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var jobs []scheduledJob
+	check := func(j *scheduledJob) {
+		if !j.next.After(now) {
+			jobs = append(jobs, *j)
+			j.next = j.rec.next(now)
+		}
+	}
+	for _, j := range l.conf {
+		check(j)
+	}
+	for _, j := range l.list {
+		check(j)
+	}
+	return jobs
+}
+
+// describe returns a line for every job, the configured ones first
+func (l *scheduleList) describe() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for _, j := range l.conf {
+		lines = append(lines, "config: "+j.describe())
+	}
+	ids := make([]int, 0, len(l.list))
+	for id := range l.list {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		j := l.list[id]
+		lines = append(lines, "#"+strconv.Itoa(id)+" by "+j.Creator+": "+j.describe())
+	}
+	return lines
+}
+
+// save persists the runtime jobs, assumes lock is held
+func (l *scheduleList) save() error {
+	list := make([]scheduledJob, 0, len(l.list))
+	for _, j := range l.list {
+		list = append(list, *j)
+	}
+	return saveState(scheduleFile, list)
+}
+
+// load reads the persisted jobs, their next run is worked out from now
+func (l *scheduleList) load() error {
+	var list []scheduledJob
+	if err := loadState(scheduleFile, &list); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, saved := range list {
+		j, err := newJob(saved.Room, saved.When, saved.Body, saved.Sender)
+		if err != nil {
+			return errors.New("schedule #" + strconv.Itoa(saved.ID) + ": " + err.Error())
+		}
+		j.ID, j.Creator = saved.ID, saved.Creator
+		l.list[j.ID] = j
+		if j.ID > l.lastID {
+			l.lastID = j.ID
+		}
+	}
+	return nil
+}
+
+// scheduleLoop sends scheduled messages when they are due
+func scheduleLoop() {
+	for {
+		time.Sleep(scheduleInterval * time.Second)
+		for _, j := range schedules.due(time.Now()) {
+			j.fire()
+		}
+	}
+}
+
+// scheduleHandler schedules a message to the room in the receiver field, or
+// to everyone for "*". The body holds the schedule followed by the message,
+// like "daily 09:55 standup in 5 minutes"
+func (c *client) scheduleHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	args := strings.SplitN(strings.TrimSpace(m.Body), " ", 3)
+	if len(args) != 3 {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "please give a schedule and a message"))
+		return
+	}
+	j, err := newJob(m.Header.Receiver, args[0]+" "+args[1], args[2], c.Nick)
+	if err == nil && j.Room != "*" {
+		rooms.mu.Lock()
+		r, ok := rooms.list[fold(j.Room)]
+		rooms.unlock()
+		if !ok {
+			err = errors.New("room " + j.Room + " doesn't exist")
+		}
+		j.Room = r.Name
+	}
+	if err == nil {
+		j.Creator = c.Nick
+		err = schedules.add(j)
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "scheduled #"+strconv.Itoa(j.ID)+": "+j.describe()))
+	logInfo("message scheduled", "oper", c.Nick, "id", j.ID, "room", j.Room, "when", j.When)
+}
+
+// unscheduleHandler deletes the runtime schedule with the id in the body
+func (c *client) unscheduleHandler(m *mirc.Message) {
+	if !c.isOper() {
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(m.Body, "#"))
+	if err == nil {
+		err = schedules.remove(id)
+	} else {
+		err = errors.New("please give the number of a schedule")
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "schedule #"+strconv.Itoa(id)+" deleted"))
+	logInfo("schedule deleted", "oper", c.Nick, "id", id)
+}
+
+// listSchedulesHandler replies with all scheduled messages
+func (c *client) listSchedulesHandler() {
+	if !c.isOper() {
+		return
+	}
+	c.send(newMsg(mirc.SERVER_RPL_LIST_SCHEDULES, c.Nick, strings.Join(schedules.describe(), " ,")))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// a Friday
+	now := time.Date(2026, 10, 16, 10, 0, 0, 0, time.Local)
+	next := func(when string) time.Time {
+		rec, err := parseWhen(when)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.next(now)
+	}
+	if got := next("daily 09:55"); !got.Equal(time.Date(2026, 10, 17, 9, 55, 0, 0, time.Local)) {
+		t.Errorf("daily schedule runs at %v", got)
+	}
+	if got := next("weekdays 09:55"); got.Weekday() != time.Monday || got.Day() != 19 {
+		t.Errorf("weekday schedule runs at %v", got)
+	}
+	if got := next("Fri,sat 10:30"); !got.Equal(time.Date(2026, 10, 16, 10, 30, 0, 0, time.Local)) {
+		t.Errorf("schedule later today runs at %v", got)
+	}
+	if got := next("fri 10:00"); got.Day() != 23 {
+		t.Errorf("weekly schedule due now runs again at %v", got)
+	}
+	if got := next("every 90m"); !got.Equal(now.Add(90 * time.Minute)) {
+		t.Errorf("interval schedule runs at %v", got)
+	}
+	for _, when := range []string{"every 10s", "daily", "someday 09:00", "daily 25:00", "every day 09:00"} {
+		if _, err := parseWhen(when); err == nil {
+			t.Errorf("invalid schedule %q accepted", when)
+		}
+	}
+}
+
+func TestScheduleDue(t *testing.T) {
+	l := scheduleList{list: map[int]*scheduledJob{}}
+	if err := l.configure([]scheduleConf{{Room: "team", When: "weekends 08:00", Body: "no standup today"}}, "mirc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.configure([]scheduleConf{{Room: "team", When: "daily 08:00"}}, "mirc"); err == nil {
+		t.Error("schedule without a message accepted")
+	}
+	j, err := newJob("*", "every 1h", "backup at midnight", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.list[1] = j
+	if jobs := l.due(time.Now()); len(jobs) != 0 {
+		t.Errorf("jobs due before their time: %v", jobs)
+	}
+	later := time.Now().Add(8 * 24 * time.Hour)
+	if jobs := l.due(later); len(jobs) != 2 || l.conf[0].Sender != "mirc" {
+		t.Errorf("unexpected due jobs %v", jobs)
+	}
+	if jobs := l.due(later); len(jobs) != 0 {
+		t.Errorf("jobs ran twice: %v", jobs)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Room history is searchable by keyword. Every room keeps an inverted index
+// from the words of its messages, and the senders, to the messages; it is
+// updated as messages are recorded, edited, deleted and trimmed so a search
+// only looks at the messages holding all of its words.
+
+// Search parameters
+const searchPageSize = 10
+const searchContext = 1
+const minWordLen = 2
+
+/******************** types ********************/
+// wordIndex maps a word to the messages of a room containing it
+type wordIndex map[string]map[int64]*historyEntry
+
+// searchQuery is a parsed search, words and filters all have to match
+type searchQuery struct {
+	words  []string
+	from   string
+	after  time.Time
+	before time.Time
+	page   int
+}
+
+/********************** Search funtions *****************/
+// tokenize splits text into the distinct lower case words the index holds
+func tokenize(text string) []string {
+	var words []string
+	seen := map[string]bool{}
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range fields {
+		if len(w) >= minWordLen && !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// senderWord is the index word of the messages sent by nick, words of
+// message text never contain ':'
+func senderWord(nick string) string {
+	return "from:" + fold(nick)
+}
+
+// indexEntry adds a message to the index of its room, notices of the server
+// are not searchable, assumes lock is held
+func (h *historyList) indexEntry(key string, e *historyEntry) {
+	if e.Sender == "server" {
+		return
+	}
+	if h.index == nil {
+		h.index = map[string]wordIndex{}
+	}
+	idx, ok := h.index[key]
+	if !ok {
+		idx = wordIndex{}
+		h.index[key] = idx
+	}
+	for _, w := range append(tokenize(e.Body), senderWord(e.Sender)) {
+		if idx[w] == nil {
+			idx[w] = map[int64]*historyEntry{}
+		}
+		idx[w][e.ID] = e
+	}
+}
+
+// unindexEntry removes a message from the index of its room, assumes lock
+// is held
+func (h *historyList) unindexEntry(key string, e *historyEntry) {
+	idx := h.index[key]
+	for _, w := range append(tokenize(e.Body), senderWord(e.Sender)) {
+		delete(idx[w], e.ID)
+		if len(idx[w]) == 0 {
+			delete(idx, w)
+		}
+	}
+}
+
+// parseSearch reads a search from keywords and the filters from:nick,
+// after:yyyy-mm-dd, before:yyyy-mm-dd and page:n
+func parseSearch(text string) (searchQuery, error) {
+	q := searchQuery{page: 1}
+	var err error
+	for _, field := range strings.Fields(text) {
+		args := strings.SplitN(field, ":", 2)
+		if len(args) == 2 && args[0] == "from" {
+			q.from = args[1]
+		} else if len(args) == 2 && args[0] == "after" {
+			q.after, err = time.ParseInLocation("2006-01-02", args[1], time.Local)
+		} else if len(args) == 2 && args[0] == "before" {
+			q.before, err = time.ParseInLocation("2006-01-02", args[1], time.Local)
+		} else if len(args) == 2 && args[0] == "page" {
+			q.page, err = strconv.Atoi(args[1])
+			if err == nil && q.page < 1 {
+				err = errors.New("page must be 1 or more")
+			}
+		} else {
+			q.words = append(q.words, tokenize(field)...)
+		}
+		if err != nil {
+			return q, errors.New("invalid search filter " + field)
+		}
+	}
+	if len(q.words) == 0 && q.from == "" {
+		return q, errors.New("please give words of at least 2 characters or from:nick to search for")
+	}
+	return q, nil
+}
+
+// match returns the messages of a room that hold every word of the query,
+// assumes lock is held
+func (h *historyList) match(key string, q searchQuery) []*historyEntry {
+	idx := h.index[key]
+	words := append([]string{}, q.words...)
+	if q.from != "" {
+		words = append(words, senderWord(q.from))
+	}
+	// start from the rarest word and drop what the others don't hold
+	sort.Slice(words, func(i, j int) bool { return len(idx[words[i]]) < len(idx[words[j]]) })
+	var found []*historyEntry
+	for id, e := range idx[words[0]] {
+		ok := (q.after.IsZero() || !e.Time.Before(q.after)) && (q.before.IsZero() || e.Time.Before(q.before))
+		for _, w := range words[1:] {
+			if !ok {
+				break
+			}
+			_, ok = idx[w][id]
+		}
+		if ok {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+// context returns the messages around a message of a room, assumes lock is
+// held
+func (h *historyList) context(key string, id int64) ([]mirc.HistoryMessage, []mirc.HistoryMessage) {
+	list := h.rooms[key]
+	for i, e := range list {
+		if e.ID != id {
+			continue
+		}
+		var before, after []mirc.HistoryMessage
+		for j := i - searchContext; j < i; j++ {
+			if j >= 0 {
+				before = append(before, mirc.HistoryMessage(*list[j]))
+			}
+		}
+		for j := i + 1; j <= i+searchContext && j < len(list); j++ {
+			after = append(after, mirc.HistoryMessage(*list[j]))
+		}
+		return before, after
+	}
+	return nil, nil
+}
+
+// search looks a query up in the history of rooms and returns the requested
+// page of hits, newest first
+func (h *historyList) search(roomNames []string, q searchQuery) mirc.SearchResult {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []*historyEntry
+	for _, name := range roomNames {
+		found = append(found, h.match(fold(name), q)...)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ID > found[j].ID })
+	result := mirc.SearchResult{
+		Page:  q.page,
+		Pages: (len(found) + searchPageSize - 1) / searchPageSize,
+		Total: len(found),
+		Hits:  []mirc.SearchHit{},
+	}
+	start := (q.page - 1) * searchPageSize
+	for i := start; i < len(found) && i < start+searchPageSize; i++ {
+		before, after := h.context(fold(found[i].Room), found[i].ID)
+		result.Hits = append(result.Hits, mirc.SearchHit{
+			Message: mirc.HistoryMessage(*found[i]),
+			Before:  before,
+			After:   after,
+		})
+	}
+	return result
+}
+
+// searchHandler searches the history of the room in the receiver field, or
+// of every room the client is in when it's empty. The body holds the query
+func (c *client) searchHandler(m *mirc.Message) {
+	q, err := parseSearch(m.Body)
+	var names []string
+	if err == nil && m.Header.Receiver != "" {
+		if !c.inRoom(m.Header.Receiver) {
+			err = errors.New("not a member of the room")
+		}
+		names = []string{m.Header.Receiver}
+	} else if err == nil {
+		rooms.mu.Lock()
+		names = roomsOf(c.Nick)
+		rooms.unlock()
+	}
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	result := history.search(names, q)
+	result.Query = m.Body
+	body, err := json.Marshal(result)
+	if err != nil {
+		logError("cannot encode search result", "nick", c.Nick, "err", err)
+		return
+	}
+	c.send(newMsg(mirc.SERVER_RPL_SEARCH, c.Nick, string(body)))
+	logDebug("search", "nick", c.Nick, "rooms", len(names), "hits", result.Total)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestHistorySearch(t *testing.T) {
+	config.HistorySize = 30
+	defer func() { config.HistorySize = 1000 }()
+	h := historyList{rooms: map[string][]*historyEntry{}}
+	say := func(opCode int16, id int64, sender string, body string) {
+		m := mirc.NewMsg(opCode, "lobby", body)
+		m.Header.Sender = sender
+		m.Header.ID = id
+		m.Header.Time = time.Date(2026, 10, int(id%28)+1, 12, 0, 0, 0, time.Local)
+		h.record(m, "")
+	}
+	say(mirc.SERVER_BROADCAST_MESSAGE, 1, "alice", "run git rebase -i HEAD~3")
+	say(mirc.SERVER_BROADCAST_MESSAGE, 2, "bob", "thanks, that worked")
+	say(mirc.SERVER_BROADCAST_MESSAGE, 3, "bob", "Git is hard")
+	search := func(text string) mirc.SearchResult {
+		q, err := parseSearch(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.search([]string{"Lobby"}, q)
+	}
+	if r := search("GIT rebase"); r.Total != 1 || r.Hits[0].Message.ID != 1 || r.Hits[0].After[0].ID != 2 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r := search("git from:BOB"); r.Total != 1 || r.Hits[0].Message.ID != 3 || r.Hits[0].Before[0].ID != 2 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r := search("git before:2026-10-04"); r.Total != 1 || r.Hits[0].Message.ID != 1 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	say(mirc.SERVER_MESSAGE_EDITED, 3, "bob", "merging is hard")
+	if r := search("git"); r.Total != 1 {
+		t.Errorf("edited message still found under its old text: %+v", r)
+	}
+	say(mirc.SERVER_MESSAGE_DELETED, 1, "alice", "")
+	if r := search("rebase"); r.Total != 0 {
+		t.Errorf("deleted message still found: %+v", r)
+	}
+	for id := int64(10); id < 40; id++ {
+		say(mirc.SERVER_BROADCAST_MESSAGE, id, "carol", "log line")
+	}
+	if r := search("merging"); r.Total != 0 {
+		t.Errorf("trimmed message still found: %+v", r)
+	}
+	if r := search("log page:3"); r.Total != 30 || r.Pages != 3 || len(r.Hits) != 10 || r.Hits[0].Message.ID != 19 {
+		t.Errorf("unexpected page %d of %d with %d hits", r.Page, r.Pages, len(r.Hits))
+	}
+	say(mirc.SERVER_BROADCAST_MESSAGE, 40, "server", "carol left lobby")
+	if r := search("left"); r.Total != 0 {
+		t.Errorf("server notice found: %+v", r)
+	}
+	if _, err := parseSearch("a after:yesterday"); err == nil {
+		t.Error("invalid date accepted")
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
-	"fmt"
+	"encoding/json"
+	"flag"
 	"net"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"errors"
@@ -19,16 +23,23 @@ const listenPort = ":6667"
 const timeout = 10
 const inactiveTimeout = 30
 
+// milliseconds to wait after a failed accept
+const acceptBackoff = 100
+
 /******************** types ********************/
 type client mirc.Client
 type room mirc.Room
 type clientList struct {
 	mu   sync.Mutex
 	list map[string]client
+	// ConnID of the last local client
+	lastConnID int64
 }
 type roomList struct {
 	mu   sync.Mutex
 	list map[string]room
+	// network writes queued while the lock is held
+	outbox []func()
 }
 
 /********************* Globals ******************/
@@ -54,90 +65,213 @@ func newMsg(opCode int16, receiver string, body string) *mirc.Message {
 	return msg
 }
 
+// send writes a message to the client and records it in the metrics
+// messages for clients on a linked server are routed over the link. A client
+// from the client list gets the message on every device, the client of a
+// request loop only on the connection the loop serves
+func (c *client) send(m *mirc.Message) error {
+	if c.Server != "" {
+		return links.route(c.Server, c.Nick, m)
+	}
+	if len(c.Devices) > 0 {
+		var err error
+		for _, d := range c.Devices {
+			if e := c.write(d, m); e != nil {
+				err = e
+			}
+		}
+		return err
+	}
+	if c.Socket == nil {
+		// detached, keep the message until the client resumes
+		if sessions.buffer(c.Nick, m) {
+			return nil
+		}
+		return errors.New(c.Nick + " is not connected")
+	}
+	return c.write(c.Socket, m)
+}
+
+// write sends a message on one connection of the client
+func (c *client) write(conn *mirc.Connection, m *mirc.Message) error {
+	err := conn.SendMsg(m)
+	metrics.sent.inc(opLabel(m.Header.OpCode))
+	if err != nil {
+		metrics.writeErrors.inc(opLabel(m.Header.OpCode))
+		logWarn("write failed", "nick", c.Nick, "opcode", m.Header.OpCode, "remote", conn.RemoteAddr(), "err", err)
+	}
+	return err
+}
+
+// echo sends a message the client sent to its other devices
+func (c *client) echo(m *mirc.Message) {
+	clients.mu.Lock()
+	cl := clients.list[fold(c.Nick)]
+	clients.mu.Unlock()
+	for _, d := range cl.Devices {
+		if d != c.Socket {
+			c.write(d, m)
+		}
+	}
+}
+
+// stampMsg gives a message its server id and time unless a linked server
+// already did
+func stampMsg(m *mirc.Message) {
+	if m.Header.ID != 0 {
+		return
+	}
+	m.Header.ID = nextMsgID()
+	m.Header.Time = time.Now()
+}
+
+// fold returns the key a nick or room name is stored under
+func fold(name string) string {
+	return mirc.CanonicalName(name)
+}
+
 // add client to the client list
-func addClient(cnick string, conn net.Conn, clients *clientList) (*client, error) {
+func addClient(cnick string, conn *mirc.Connection, clients *clientList) (*client, error) {
+	if err := mirc.ValidateNick(cnick); err != nil {
+		return nil, err
+	}
 	clients.mu.Lock()
-	if _, ok := clients.list[cnick]; ok {
+	if _, ok := clients.list[fold(cnick)]; ok {
 		//  Cannot add duplicated nickname
 		clients.mu.Unlock()
 		return nil, errors.New("nickname exists")
 	}
 
+	now := time.Now()
+	clients.lastConnID++
 	newClient := client{
-		IP:      conn.RemoteAddr(),
-		Nick:    cnick,
-		Timeout: time.Now().Add(time.Second * time.Duration(timeout)),
-		Socket:  &mirc.Connection{conn},
+		ConnID:     clients.lastConnID,
+		IP:         conn.RemoteAddr(),
+		Nick:       cnick,
+		Timeout:    now.Add(time.Second * time.Duration(timeout)),
+		Socket:     conn,
+		Connected:  now,
+		LastActive: now,
+		Devices:    []*mirc.Connection{conn},
 	}
-	clients.list[cnick] = newClient
+	clients.list[fold(cnick)] = newClient
+	newClient.Devices = nil
 	clients.mu.Unlock()
+	links.announce(newLinkMsg(mirc.SERVER_LINK_NICK, "", cnick), "")
 	rooms.mu.Lock()
 	r := rooms.list["public"]
 	r.addMember(cnick)
 	rooms.list["public"] = r
-	rooms.mu.Unlock()
-	fmt.Printf("%s added to %s\n", cnick, r)
+	rooms.unlock()
+	logInfo("room joined", "nick", cnick, "room", r.Name)
+	autoJoin(cnick)
 	return &newClient, nil
 }
 
 // remove client from the client list
 func removeClient(nick string, clientMap map[string]client) int {
 	clients.mu.Lock()
-	if _, ok := clientMap[nick]; ok {
-		delete(clientMap, nick)
+	c, ok := clientMap[fold(nick)]
+	if ok {
+		delete(clientMap, fold(nick))
 	}
 	clients.mu.Unlock()
+	typing.forget(nick)
+	if !accounts.registered(nick) {
+		markers.forget(nick)
+		mentions.forget(nick)
+		ignores.forget(nick)
+	}
+	var left []string
 	rooms.mu.Lock()
-	for roomName := range rooms.list {
-		r := rooms.list[roomName]
+	for key, r := range rooms.list {
+		if containFold(r.Members, nick) < 0 {
+			continue
+		}
+		left = append(left, r.Name)
 		r.removeMember(nick)
-		if len(r.Members) > 0 {
-			rooms.list[roomName] = r
+		if len(r.Members) > 0 || r.permanent() {
+			rooms.list[key] = r
 		}
 	}
-	rooms.mu.Unlock()
+	rooms.unlock()
+	if ok {
+		for _, roomName := range left {
+			c.leaveHooks(roomName)
+		}
+		links.announce(newLinkMsg(mirc.SERVER_LINK_QUIT, "", nick), c.Server)
+	}
 	return 0
 }
 
+// post queues a network write until the rooms lock is released, assumes
+// lock is held
+func (l *roomList) post(f func()) {
+	l.outbox = append(l.outbox, f)
+}
+
+// unlock releases the rooms lock and then does the writes queued under it,
+// a slow connection must not hold up everyone waiting for the lock
+func (l *roomList) unlock() {
+	outbox := l.outbox
+	l.outbox = nil
+	l.mu.Unlock()
+	for _, f := range outbox {
+		f()
+	}
+}
+
 // create a new room
 func addRoom(roomName string, nick string) error {
+	if err := mirc.ValidateRoom(roomName); err != nil {
+		return err
+	}
 	rooms.mu.Lock()
-	if _, ok := rooms.list[roomName]; ok {
-		rooms.mu.Unlock()
+	if _, ok := rooms.list[fold(roomName)]; ok {
+		rooms.unlock()
 		return errors.New("room exists")
 	}
-	newRoom := room{Name: roomName}
+	newRoom := room{Name: roomName, Created: time.Now()}
+	if nick != "server" {
+		newRoom.Ops = []string{nick}
+	}
 	newRoom.addMember(nick)
-	rooms.list[roomName] = newRoom
-	rooms.mu.Unlock()
+	rooms.list[fold(roomName)] = newRoom
+	rooms.unlock()
 	return nil
 }
 
 // add a client to a room
 func (c *client) joinRoom(roomName string) error {
 	rooms.mu.Lock()
-	if _, ok := rooms.list[roomName]; !ok {
-		rooms.mu.Unlock()
+	r, ok := rooms.list[fold(roomName)]
+	if !ok {
+		rooms.unlock()
 		return errors.New("room doesn't exist")
 	}
-	r := rooms.list[roomName]
 	r.addMember(c.Nick)
-	rooms.list[roomName] = r
-	rooms.mu.Unlock()
-	fmt.Printf("%s is added to %s\n", c.Nick, r)
+	rooms.list[fold(roomName)] = r
+	rooms.unlock()
+	logInfo("room joined", "nick", c.Nick, "room", r.Name)
 	return nil
 }
 
 // add member to a room assumes lock is held
 func (r *room) addMember(nick string) error {
-	if contain(r.Members, nick) >= 0 {
+	if containFold(r.Members, nick) >= 0 {
 		//  Cannot add duplicated nickname
-		fmt.Printf("%s is already in %s\n", nick, r.Name)
+		logDebug("already a member", "nick", nick, "room", r.Name)
 		return errors.New("nickname exists")
 	}
 
 	r.Members = append(r.Members, nick)
-	if len(r.Members) > 1 {
+	from := origin(nick)
+	if nick != "server" {
+		join := newLinkMsg(mirc.SERVER_LINK_JOIN, r.Name, nick)
+		rooms.post(func() { links.announce(join, from) })
+	}
+	// members joining on a linked server are announced by that server
+	if len(r.Members) > 1 && from == "" {
 		m := nick + " joined"
 		broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, r.Name, m))
 	}
@@ -146,12 +280,17 @@ func (r *room) addMember(nick string) error {
 
 // remove member from a room assumes lock is held
 func (r *room) removeMember(nick string) error {
-	i := contain(r.Members, nick)
+	i := containFold(r.Members, nick)
 	if i >= 0 {
 		r.Members = append(r.Members[:i], r.Members[i+1:]...)
-		if len(r.Members) <= 0 {
-			delete(rooms.list, r.Name)
-			fmt.Printf("empty room %s has been removed\n", r.Name)
+		if nick != "server" {
+			part, from := newLinkMsg(mirc.SERVER_LINK_PART, r.Name, nick), origin(nick)
+			rooms.post(func() { links.announce(part, from) })
+		}
+		if len(r.Members) <= 0 && !r.permanent() {
+			delete(rooms.list, fold(r.Name))
+			history.drop(r.Name)
+			logInfo("empty room removed", "room", r.Name)
 		}
 		return nil
 	}
@@ -161,10 +300,51 @@ func (r *room) removeMember(nick string) error {
 
 // handles client's error messages
 func (c *client) errorHandler() {
+	// best effort, the peer is usually gone already
+	c.Socket.SendMsg(newMsg(mirc.CONNECTION_CLOSED, c.Nick, "server has closed your connection"))
 	c.Socket.Conn.Close()
 	removeClient(c.Nick, clients.list)
-	c.Socket.SendMsg(newMsg(mirc.CONNECTION_CLOSED, c.Nick, "server has closed your connection"))
-	fmt.Printf("%s has disconnected\n", c.Nick)
+	c.disconnectHooks()
+	logInfo("client disconnected", "nick", c.Nick, "remote", c.IP)
+}
+
+// touch records that the client has just made a request with opCode
+func (c *client) touch(opCode int16) {
+	c.LastActive = time.Now()
+	back := false
+	clients.mu.Lock()
+	if cl, ok := clients.list[fold(c.Nick)]; ok {
+		cl.LastActive = c.LastActive
+		back = cl.AutoAway
+		clients.list[fold(c.Nick)] = cl
+	}
+	clients.mu.Unlock()
+	// activity ends an away status the server set automatically, the away
+	// command sets the status itself
+	if back && opCode != mirc.CLIENT_AWAY {
+		setAway(c.Nick, "", false)
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "you are no longer marked as away"))
+	}
+}
+
+// inRoom reports whether the client is a member of a room
+func (c *client) inRoom(roomName string) bool {
+	rooms.mu.Lock()
+	defer rooms.unlock()
+	r, ok := rooms.list[fold(roomName)]
+	return ok && containFold(r.Members, c.Nick) >= 0
+}
+
+// roomsOf lists the rooms a nick is a member of, assumes rooms lock is held
+func roomsOf(nick string) []string {
+	var names []string
+	for _, r := range rooms.list {
+		if containFold(r.Members, nick) >= 0 {
+			names = append(names, r.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 // remove client from the client list
@@ -174,81 +354,90 @@ func (c *client) removeClientHandler() int {
 
 //addRoomHandler
 func (c *client) addRoomHandler(m *mirc.Message) {
-	err := addRoom(m.Body, m.Header.Sender)
+	if err := c.joinHooks(m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	err := addRoom(m.Body, c.Nick)
 	if err != nil {
 		c.Socket.SetWriteDeadline(mirc.CalDeadline(timeout))
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
 	}
 	c.Socket.SetWriteDeadline(mirc.CalDeadline(timeout))
 	msgBody := "Room " + m.Body + " created!\n"
-	c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
-	fmt.Printf("room %s created\n", m.Body)
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
+	c.sendMarker(m.Body)
+	logInfo("room created", "nick", c.Nick, "room", m.Body)
 	return
 }
 
 // joinRoomHandler
 func (c *client) joinRoomHandler(m *mirc.Message) {
+	if err := c.joinHooks(m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
 	err := c.joinRoom(m.Body)
 	if err != nil {
 		c.Socket.SetWriteDeadline(mirc.CalDeadline(timeout))
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
 	}
 	c.Socket.SetWriteDeadline(mirc.CalDeadline(timeout))
 	msgBody := "You joined " + m.Body + "!\n"
-	c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
+	c.sendMarker(m.Body)
 	return
 }
 
 // handles clent's leave room request
 func (c *client) leaveRoomHandler(m *mirc.Message) {
 	if len(m.Body) <= 0 {
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "invalid command! please specify room name"))
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "invalid command! please specify room name"))
 		return
 	}
-	r := rooms.list[m.Body]
-	err := r.removeMember(c.Nick)
-	if err != nil {
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "not a member of the room"))
-	} else if m.Body == "public" {
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "cannot leave public room"))
-	} else {
-		if len(r.Members) > 0 {
-			rooms.list[m.Body] = r
-			msg := m.Header.Sender + " left the room"
-			broadCastMsg(newMsg(mirc.SERVER_BROADCAST_MESSAGE, m.Body, msg))
-		}
-		m := "you have left the room " + m.Body
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, m))
+	if err := partRoom(c.Nick, m.Body); err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
 	}
+	c.leaveHooks(m.Body)
+	msgBody := "you have left the room " + m.Body
+	c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
 	return
 }
 
-// list all rooms of client's request
-func (c *client) listRoomHandler() {
-	var roomList []string
-	rooms.mu.Lock()
-	for name := range rooms.list {
-		roomList = append(roomList, name)
+// list the rooms the client can see as json, the body holds an optional
+// pattern and the sort and page options
+func (c *client) listRoomHandler(m *mirc.Message) {
+	q, err := parseRoomQuery(m.Body)
+	if err != nil {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+		return
+	}
+	msgBody, err := json.Marshal(c.listRooms(q))
+	if err != nil {
+		logError("cannot encode room list", "nick", c.Nick, "err", err)
+		return
 	}
-	rooms.mu.Unlock()
-	msgBody := strings.Join(roomList, " ,")
-	c.Socket.SendMsg(newMsg(mirc.SERVER_RPL_LIST_ROOM, c.Nick, msgBody))
+	c.send(newMsg(mirc.SERVER_RPL_LIST_ROOM, c.Nick, string(msgBody)))
 	return
 }
 
 // list all members of a room that client's requested
 func (c *client) listMemberHandler(room string) {
 	rooms.mu.Lock()
-	if _, ok := rooms.list[room]; !ok {
-		rooms.mu.Unlock()
+	r, ok := rooms.list[fold(room)]
+	if !ok || !r.visibleTo(c) {
+		rooms.unlock()
 		c.Socket.SetWriteDeadline(mirc.CalDeadline(timeout))
 		msgBody := "room " + room + " doesn't exist.\n"
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
 		return
 	}
-	msgBody := strings.Join(rooms.list[room].Members, " ,")
-	rooms.mu.Unlock()
-	c.Socket.SendMsg(newMsg(mirc.SERVER_RPL_LIST_MEMBER, c.Nick, msgBody))
+	msgBody := strings.Join(memberNames(r.Members), " ,")
+	rooms.unlock()
+	c.send(newMsg(mirc.SERVER_RPL_LIST_MEMBER, c.Nick, msgBody))
 	return
 }
 
@@ -256,86 +445,258 @@ func (c *client) listMemberHandler(room string) {
 // replies with "true" if it's a member and "false" if not a member
 func (c *client) inRoomHandler(room string) {
 	rooms.mu.Lock()
-	if _, ok := rooms.list[room]; !ok {
-		rooms.mu.Unlock()
+	r, ok := rooms.list[fold(room)]
+	if !ok || !r.visibleTo(c) {
+		rooms.unlock()
 		c.Socket.SetWriteDeadline(mirc.CalDeadline(timeout))
 		msgBody := "room " + room + " doesn't exist.\n"
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, msgBody))
 		return
 	}
-	if contain(rooms.list[room].Members, c.Nick) < 0 {
-		rooms.mu.Unlock()
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "not a member of the room"))
+	if containFold(r.Members, c.Nick) < 0 {
+		rooms.unlock()
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "not a member of the room"))
 		return
 	}
-	rooms.mu.Unlock()
-	c.Socket.SendMsg(newMsg(mirc.SERVER_RPL_CLIENT_IN_ROOM, c.Nick, room))
+	rooms.unlock()
+	c.send(newMsg(mirc.SERVER_RPL_CLIENT_IN_ROOM, c.Nick, r.Name))
 	return
 }
 
 // server passes rallied message to the receiver
-func rallyMsg(m *mirc.Message) {
-	if _, ok := clients.list[m.Header.Receiver]; !ok {
+// reports whether the receiver exists
+func rallyMsg(m *mirc.Message) bool {
+	clients.mu.Lock()
+	c, ok := clients.list[fold(m.Header.Receiver)]
+	sender := clients.list[fold(m.Header.Sender)]
+	clients.mu.Unlock()
+	if !ok {
 		msgBody := "Receiver " + m.Header.Receiver + " doesn't exist.\n"
-		c := clients.list[m.Header.Sender]
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, m.Header.Sender, msgBody))
-		return
+		sender.send(newMsg(mirc.SERVER_TELL_MESSAGE, m.Header.Sender, msgBody))
+		return false
 	}
 	m.Header.OpCode = mirc.SERVER_TELL_MESSAGE
-	c := clients.list[m.Header.Receiver]
-	c.Socket.SendMsg(m)
-	return
+	m.Header.Receiver = c.Nick
+	stampMsg(m)
+	if ignores.ignoring(c.Nick, m.Header.Sender) {
+		// dropped quietly, the sender isn't told
+		return true
+	}
+	c.send(m)
+	awayReply(m)
+	return true
 }
 
-// broadCastMsg sends passes message to all members in a room
+// broadCastMsg sends passes message to all members in a room, assumes the
+// rooms lock is held and sends once it is released
 func broadCastMsg(m *mirc.Message) {
-	if _, ok := rooms.list[m.Header.Receiver]; !ok {
+	r, ok := rooms.list[fold(m.Header.Receiver)]
+	if !ok {
 		msgBody := "Room " + m.Header.Receiver + " doesn't exist.\n"
-		c := clients.list[m.Header.Sender]
-		c.Socket.SendMsg(newMsg(mirc.SERVER_TELL_MESSAGE, m.Header.Sender, msgBody))
+		clients.mu.Lock()
+		c := clients.list[fold(m.Header.Sender)]
+		clients.mu.Unlock()
+		rooms.post(func() { c.send(newMsg(mirc.SERVER_TELL_MESSAGE, m.Header.Sender, msgBody)) })
 		return
 	}
-	receiverList := rooms.list[m.Header.Receiver].Members
-	m.Header.OpCode = mirc.SERVER_BROADCAST_MESSAGE
-	for i := 0; i < len(receiverList); i++ {
-		cNick := receiverList[i]
-		if cNick != "server" {
-			c := clients.list[cNick]
-			c.Socket.SendMsg(m)
+	m.Header.Receiver = r.Name
+	stampMsg(m)
+	deliverBroadcast(m, "")
+	recordMentions(m, r)
+	return
+}
+
+// deliverBroadcast sends a room message to the local members and relays it
+// once to every link with members behind it, except the link it came from,
+// assumes the rooms lock is held and sends once it is released
+func deliverBroadcast(m *mirc.Message, from string) {
+	r, ok := rooms.list[fold(m.Header.Receiver)]
+	if !ok {
+		return
+	}
+	if m.Header.OpCode == mirc.CLIENT_SEND_PUB_MESSAGE {
+		m.Header.OpCode = mirc.SERVER_BROADCAST_MESSAGE
+	}
+	author := ""
+	if from == "" && m.Header.OpCode == mirc.SERVER_BROADCAST_MESSAGE {
+		author = authorOf(m.Header.Sender)
+	}
+	history.record(m, author)
+	if m.Header.OpCode == mirc.SERVER_MESSAGE_DELETED {
+		mentions.retract(r.Name, m.Header.ID)
+	}
+	var receivers []client
+	relays := map[string]bool{}
+	clients.mu.Lock()
+	for _, cNick := range r.Members {
+		c, ok := clients.list[fold(cNick)]
+		if cNick == "server" || !ok {
+			continue
+		}
+		if c.Server == "" {
+			if !ignores.ignoring(c.Nick, m.Header.Sender) {
+				receivers = append(receivers, c)
+			}
+		} else if c.Server != from {
+			relays[c.Server] = true
 		}
 	}
-	return
+	clients.mu.Unlock()
+	rooms.post(func() {
+		for _, c := range receivers {
+			c.send(m)
+		}
+		for name := range relays {
+			links.relay(name, m)
+		}
+		metrics.fanout.observe(float64(len(receivers) + len(relays)))
+		if m.Header.OpCode == mirc.SERVER_BROADCAST_MESSAGE {
+			notifyWebhooks(m)
+		}
+	})
+}
+
+// messageHandler runs the message hooks and delivers a room or private message
+func (c *client) messageHandler(m *mirc.Message) {
+	m.Header.Sender = c.Nick
+	if m.Header.OpCode != mirc.CLIENT_SEND_PUB_MESSAGE {
+		m.Header.Parent = 0
+	} else if m.Header.Parent != 0 {
+		if err := threadParent(m); err != nil {
+			c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, err.Error()))
+			return
+		}
+	}
+	deliver, reply := c.messageHooks(m)
+	if deliver && m.Header.OpCode == mirc.CLIENT_SEND_PUB_MESSAGE {
+		rooms.mu.Lock()
+		broadCastMsg(m)
+		rooms.unlock()
+	} else if deliver && rallyMsg(m) {
+		c.echo(m)
+	}
+	reply.flush()
 }
 
 // handles requests from clients
 func (c *client) requestHandler() {
+	defer deviceCaps.forget(c.Socket)
 	for {
-		c.Socket.Conn.SetReadDeadline(mirc.CalDeadline(inactiveTimeout))
+		deadline := mirc.CalDeadline(inactiveTimeout)
+		c.Socket.Conn.SetReadDeadline(deadline)
 		opCode, msg := c.Socket.GetMsg()
 		if opCode == mirc.ERROR {
+			if time.Now().After(deadline) {
+				metrics.disconnected(c.Nick, "timeout")
+			} else {
+				metrics.disconnected(c.Nick, "connection_lost")
+			}
+			if c.leave() > 0 {
+				c.Socket.Conn.Close()
+				logInfo("device disconnected", "nick", c.Nick, "remote", c.Socket.RemoteAddr())
+				return
+			}
+			if c.detach() {
+				return
+			}
 			c.errorHandler()
 			return
 		}
-		if opCode == mirc.CLIENT_SEND_PUB_MESSAGE {
-			broadCastMsg(msg)
-		} else if opCode == mirc.CLIENT_SEND_MESSAGE {
-			rallyMsg(msg)
+		metrics.received.inc(opLabel(opCode))
+		logDebug("request", "nick", c.Nick, "opcode", opCode, "receiver", msg.Header.Receiver)
+		if opCode != mirc.CONNECTION_PING {
+			c.touch(opCode)
+		}
+		if opCode == mirc.CLIENT_SEND_PUB_MESSAGE || opCode == mirc.CLIENT_SEND_MESSAGE {
+			c.messageHandler(msg)
 		} else if opCode == mirc.CONNECTION_PING {
-			c.Socket.SendMsg(newMsg(mirc.CONNECTION_ACK, c.Nick, "pong"))
+			c.send(newMsg(mirc.CONNECTION_ACK, c.Nick, "pong"))
 		} else if opCode == mirc.CONNECTION_CLOSED {
+			// the client stays connected on its other devices
+			if c.leave() > 0 {
+				c.Socket.Conn.Close()
+				logInfo("device disconnected", "nick", c.Nick, "remote", c.Socket.RemoteAddr())
+				return
+			}
+			metrics.setDisconnectReason(c.Nick, "quit")
+			sessions.drop(c.Nick)
 			removeClient(c.Nick, clients.list)
 		} else if opCode == mirc.CLIENT_CREATE_ROOM {
 			c.addRoomHandler(msg)
 		} else if opCode == mirc.CLIENT_JOIN_ROOM {
 			c.joinRoomHandler(msg)
 		} else if opCode == mirc.CLIENT_LIST_ROOM {
-			c.listRoomHandler()
+			c.listRoomHandler(msg)
 		} else if opCode == mirc.CLIENT_IN_ROOM {
 			c.inRoomHandler(msg.Body)
 		} else if opCode == mirc.CLIENT_LEAVE_ROOM {
 			c.leaveRoomHandler(msg)
 		} else if opCode == mirc.CLIENT_LIST_MEMBER {
 			c.listMemberHandler(msg.Body)
+		} else if opCode == mirc.CLIENT_OPER {
+			c.operHandler(msg)
+		} else if opCode == mirc.CLIENT_KILL {
+			c.killHandler(msg)
+		} else if opCode == mirc.CLIENT_WALL {
+			c.wallHandler(msg)
+		} else if opCode == mirc.CLIENT_DELETE_ROOM {
+			c.deleteRoomHandler(msg)
+		} else if opCode == mirc.CLIENT_FORCE_JOIN {
+			c.forceJoinHandler(msg)
+		} else if opCode == mirc.CLIENT_FORCE_PART {
+			c.forcePartHandler(msg)
+		} else if opCode == mirc.CLIENT_BAN {
+			c.banHandler(msg)
+		} else if opCode == mirc.CLIENT_UNBAN {
+			c.unbanHandler(msg)
+		} else if opCode == mirc.CLIENT_LIST_BANS {
+			c.listBansHandler()
+		} else if opCode == mirc.CLIENT_CREATE_HOOK {
+			c.createHookHandler(msg)
+		} else if opCode == mirc.CLIENT_REVOKE_HOOK {
+			c.revokeHookHandler(msg)
+		} else if opCode == mirc.CLIENT_LIST_HOOKS {
+			c.listHooksHandler()
+		} else if opCode == mirc.CLIENT_IGNORE {
+			c.ignoreHandler(msg)
+		} else if opCode == mirc.CLIENT_UNIGNORE {
+			c.unignoreHandler(msg)
+		} else if opCode == mirc.CLIENT_LIST_IGNORES {
+			c.listIgnoresHandler()
+		} else if opCode == mirc.CLIENT_SCHEDULE {
+			c.scheduleHandler(msg)
+		} else if opCode == mirc.CLIENT_UNSCHEDULE {
+			c.unscheduleHandler(msg)
+		} else if opCode == mirc.CLIENT_LIST_SCHEDULES {
+			c.listSchedulesHandler()
+		} else if opCode == mirc.CLIENT_AWAY {
+			c.awayHandler(msg)
+		} else if opCode == mirc.CLIENT_WHOIS {
+			c.whoisHandler(msg)
+		} else if opCode == mirc.CLIENT_CHANGE_NICK {
+			c.changeNickHandler(msg)
+		} else if opCode == mirc.CLIENT_REGISTER {
+			c.registerHandler(msg)
+		} else if opCode == mirc.CLIENT_EDIT_MESSAGE {
+			c.editMessageHandler(msg)
+		} else if opCode == mirc.CLIENT_DELETE_MESSAGE {
+			c.deleteMessageHandler(msg)
+		} else if opCode == mirc.CLIENT_GET_THREAD {
+			c.threadHandler(msg)
+		} else if opCode == mirc.CLIENT_CAPS {
+			c.capsHandler(msg)
+		} else if opCode == mirc.CLIENT_TYPING {
+			c.typingHandler(msg)
+		} else if opCode == mirc.CLIENT_MARK_READ {
+			c.markReadHandler(msg)
+		} else if opCode == mirc.CLIENT_LIST_MENTIONS {
+			c.mentionsHandler(msg)
+		} else if opCode == mirc.CLIENT_SEARCH {
+			c.searchHandler(msg)
+		} else if opCode == mirc.CLIENT_SET_TOPIC {
+			c.topicHandler(msg)
+		} else if opCode == mirc.CLIENT_SET_MODE {
+			c.modeHandler(msg)
 		}
 	}
 }
@@ -345,60 +706,222 @@ func (c *client) requestHandler() {
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 	// boostrap client connection
-	con := mirc.Connection{conn}
+	con := &mirc.Connection{Conn: conn}
 	con.Conn.SetReadDeadline(mirc.CalDeadline(timeout))
 	opCode, msg := con.GetMsg()
-	if opCode != 100 {
+	if opCode == mirc.SERVER_LINK {
+		acceptLink(con, msg)
+		return
+	}
+	if opCode == mirc.CLIENT_LOGIN {
+		loginConnection(con, msg)
+		return
+	}
+	if opCode == mirc.CLIENT_RESUME {
+		client, err := resumeSession(con, msg.Body)
+		if err != nil {
+			con.SendMsg(newMsg(mirc.CONNECTION_CLOSED, "", err.Error()))
+			logInfo("resume refused", "remote", conn.RemoteAddr(), "err", err)
+			return
+		}
+		logInfo("session resumed", "nick", client.Nick, "remote", conn.RemoteAddr())
+		client.sendMarkers()
+		client.requestHandler()
+		return
+	}
+	if opCode != mirc.CLIENT_REQUEST_CONNECTION {
 		// Silently drop the invalid Connection
+		logDebug("invalid handshake dropped", "remote", conn.RemoteAddr(), "opcode", opCode)
 		return
 	}
 	nick := msg.Body
 
 	// ask client to change their nickname if it's taken
-	client, err := addClient(nick, conn, &clients)
+	client, err := addGuest(nick, con)
 	for err != nil {
 		// If nickname exists then client will be asked
 		// to change
 		con.Conn.SetWriteDeadline(mirc.CalDeadline(timeout))
-		con.SendMsg(newMsg(mirc.CONNECTION_FAILURE, nick, "nickname exists"))
+		con.SendMsg(newMsg(mirc.CONNECTION_FAILURE, nick, err.Error()))
 		con.Conn.SetReadDeadline(mirc.CalDeadline(timeout))
 		opCode, msg = con.GetMsg()
 		if opCode == mirc.CLIENT_CHANGE_NICK {
+			logDebug("nickname taken, retrying", "nick", nick, "new", msg.Body, "remote", conn.RemoteAddr())
 			nick = msg.Body
-		} else if opCode < 0 {
+		} else if opCode == mirc.ERROR {
 			// Client quit unexpectly
+			logDebug("client left during handshake", "nick", nick, "remote", conn.RemoteAddr())
 			con.Conn.Close()
 			return
 		}
-		client, err = addClient(nick, conn, &clients)
+		client, err = addGuest(nick, con)
 	}
-	con.Conn.SetWriteDeadline(mirc.CalDeadline(timeout))
-	con.SendMsg(newMsg(mirc.CONNECTION_SUCCESS, nick, "Connection established"))
-
-	fmt.Printf("%s has connected\n", nick)
-	fmt.Printf("ip: %s\n", clients.list[nick].IP)
+	client.welcome()
 	client.requestHandler()
-	fmt.Printf("Client %s has left\n", nick)
+	logDebug("request loop finished", "nick", nick)
 	return
 }
 
+// welcome confirms the connection of a new client, hands out its resume
+// token and runs the connect hooks
+func (c *client) welcome() {
+	c.Socket.Conn.SetWriteDeadline(mirc.CalDeadline(timeout))
+	c.send(newMsg(mirc.CONNECTION_SUCCESS, c.Nick, "Connection established"))
+	if currentConfig().ResumeGrace > 0 {
+		if token, err := sessions.open(c.Nick); err == nil {
+			c.send(newMsg(mirc.SERVER_RESUME_TOKEN, c.Nick, token))
+		} else {
+			logError("cannot issue resume token", "nick", c.Nick, "err", err)
+		}
+	}
+	c.sendMarkers()
+	logInfo("client connected", "nick", c.Nick, "remote", c.IP)
+	if err := c.connectHooks(); err != nil {
+		logInfo("client refused by hook", "nick", c.Nick, "remote", c.IP, "err", err)
+		disconnect(c.Nick, "hook", err.Error())
+	}
+}
+
+// rejectConnection tells a client why it was refused and closes the socket
+func rejectConnection(conn net.Conn, reason error) {
+	con := mirc.Connection{Conn: conn}
+	con.SendMsg(newMsg(mirc.CONNECTION_CLOSED, "", reason.Error()))
+	conn.Close()
+	logWarn("connection refused", "remote", conn.RemoteAddr(), "reason", reason)
+}
+
+// reloadOnHangup rereads the configuration and the ban list on SIGHUP so
+// limits and bans can be changed without restarting the server
+func reloadOnHangup(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloaded, err := loadConf(path)
+		if err != nil {
+			logError("cannot reload configuration", "path", path, "err", err)
+			continue
+		}
+		// the data directory and listen address only apply at start up
+		running := currentConfig()
+		reloaded.Listen, reloaded.DataDir = running.Listen, running.DataDir
+		if err := serverLog.configure(reloaded.LogLevel, reloaded.LogFormat); err != nil {
+			logError("cannot reload configuration", "path", path, "err", err)
+			continue
+		}
+		if err := schedules.configure(reloaded.Schedules, reloaded.ServerName); err != nil {
+			logError("cannot reload configuration", "path", path, "err", err)
+			continue
+		}
+		setConfig(reloaded)
+		startWebhooks(reloaded.Webhooks)
+		if err := keepRooms(append(reloaded.PermanentRooms, reloaded.AutoJoin...)); err != nil {
+			logError("cannot reload permanent rooms", "err", err)
+		}
+		if err := bans.load(); err != nil {
+			logError("cannot reload ban list", "err", err)
+		}
+		logInfo("configuration reloaded", "path", path)
+	}
+}
+
 func main() {
-	ln, err := net.Listen("tcp", listenPort)
+	configPath := flag.String("config", "server.yaml", "path to the server configuration file")
+	flag.Parse()
+	if err := getConf(*configPath, &config); err != nil {
+		logError("cannot parse configuration file", "path", *configPath, "err", err)
+		os.Exit(-1)
+	}
+	if err := serverLog.configure(config.LogLevel, config.LogFormat); err != nil {
+		logError("invalid logging configuration", "path", *configPath, "err", err)
+		os.Exit(-1)
+	}
+	if err := bans.load(); err != nil {
+		logError("cannot load ban list", "err", err)
+		os.Exit(-1)
+	}
+	if err := incomingHooks.load(); err != nil {
+		logError("cannot load incoming webhooks", "err", err)
+		os.Exit(-1)
+	}
+	if err := accounts.load(); err != nil {
+		logError("cannot load accounts", "err", err)
+		os.Exit(-1)
+	}
+	if err := markers.load(); err != nil {
+		logError("cannot load read markers", "err", err)
+		os.Exit(-1)
+	}
+	if err := mentions.load(); err != nil {
+		logError("cannot load mentions", "err", err)
+		os.Exit(-1)
+	}
+	if err := ignores.load(); err != nil {
+		logError("cannot load ignore lists", "err", err)
+		os.Exit(-1)
+	}
+	if err := schedules.configure(config.Schedules, config.ServerName); err != nil {
+		logError("invalid schedule", "path", *configPath, "err", err)
+		os.Exit(-1)
+	}
+	if err := schedules.load(); err != nil {
+		logError("cannot load schedules", "err", err)
+		os.Exit(-1)
+	}
+	// the configuration may be reloaded from here on
+	conf := config
+	go reloadOnHangup(*configPath)
+	if conf.HTTPListen != "" {
+		go serveHTTP(conf.HTTPListen)
+	}
+	startWebhooks(conf.Webhooks)
+	go autoAwayLoop()
+	go scheduleLoop()
+	go flushLoop()
+	for _, lc := range conf.Links {
+		if lc.Addr != "" {
+			go dialLink(lc)
+		}
+	}
+
+	ln, err := net.Listen("tcp", conf.Listen)
 
 	if err != nil {
 		// handle error
-		fmt.Print("Server failed to start...\n")
-		fmt.Printf("ERROR: %v\n", err)
+		logError("server failed to start", "addr", conf.Listen, "err", err)
 		os.Exit(-1)
 	}
-	fmt.Print("Server has started. Control + C to exit\n")
+	logInfo("server started", "addr", conf.Listen)
 	addRoom("public", "server")
+	if err := loadRooms(); err != nil {
+		logError("cannot load permanent rooms", "err", err)
+		os.Exit(-1)
+	}
+	// auto-join rooms are always there to join
+	if err := keepRooms(append(conf.PermanentRooms, conf.AutoJoin...)); err != nil {
+		logError("invalid permanent room", "path", *configPath, "err", err)
+		os.Exit(-1)
+	}
 	for {
 		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			logError("listener closed", "addr", conf.Listen)
+			os.Exit(-1)
+		}
 		if err != nil {
-			// handle error
+			logError("accept failed", "err", err)
+			// errors like running out of file descriptors last a while
+			time.Sleep(acceptBackoff * time.Millisecond)
+			continue
+		}
+		ip := remoteIP(conn.RemoteAddr())
+		if err := limiter.admit(ip); err != nil {
+			rejectConnection(conn, err)
+			continue
 		}
-		go handleConnection(conn)
+		go func() {
+			defer limiter.release(ip)
+			handleConnection(conn)
+		}()
 	}
 }
 
@@ -414,3 +937,13 @@ func contain(list []string, el string) int {
 	}
 	return -1
 }
+
+// like contain but ignores case, for nicks and room names
+func containFold(list []string, el string) int {
+	for i, v := range list {
+		if fold(v) == fold(el) {
+			return i
+		}
+	}
+	return -1
+}
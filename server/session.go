@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Clients get a resume token when they log in. When the connection drops
+// the client is detached instead of removed: it keeps its nick and rooms
+// for config.ResumeGrace seconds and messages sent to it are kept until it
+// reconnects with the token or the grace period ends.
+
+// most messages kept for a detached client
+const resumeBacklog = 200
+
+/******************** types ********************/
+type session struct {
+	token  string
+	nick   string
+	missed []*mirc.Message
+	expire *time.Timer
+}
+
+// sessionList locks after clientList
+type sessionList struct {
+	mu      sync.Mutex
+	byToken map[string]*session
+	byNick  map[string]*session
+}
+
+/********************* Globals ******************/
+
+// resumable sessions of local clients
+var sessions = sessionList{
+	mu:      sync.Mutex{},
+	byToken: map[string]*session{},
+	byNick:  map[string]*session{},
+}
+
+/********************** Session funtions *****************/
+// open returns the resume token of a nick, all devices of a nick share it
+func (l *sessionList) open(nick string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.byNick[fold(nick)]; ok {
+		return s.token, nil
+	}
+	s := &session{token: token, nick: nick}
+	l.byToken[token] = s
+	l.byNick[fold(nick)] = s
+	return token, nil
+}
+
+// drop ends the session of a nick, it can't be resumed any more
+func (l *sessionList) drop(nick string) {
+	l.mu.Lock()
+	l.forget(nick)
+	l.mu.Unlock()
+}
+
+// forget removes the session of a nick, assumes lock is held
+func (l *sessionList) forget(nick string) {
+	s, ok := l.byNick[fold(nick)]
+	if !ok {
+		return
+	}
+	if s.expire != nil {
+		s.expire.Stop()
+	}
+	delete(l.byToken, s.token)
+	delete(l.byNick, fold(nick))
+}
+
+// rename moves the session of a nick to its new nick
+func (l *sessionList) rename(oldNick string, newNick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok := l.byNick[fold(oldNick)]; ok {
+		delete(l.byNick, fold(oldNick))
+		s.nick = newNick
+		l.byNick[fold(newNick)] = s
+	}
+}
+
+// buffer keeps a message for a detached nick until it resumes, the oldest
+// messages are dropped once the backlog is full
+func (l *sessionList) buffer(nick string, m *mirc.Message) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.byNick[fold(nick)]
+	if !ok {
+		return false
+	}
+	if len(s.missed) >= resumeBacklog {
+		s.missed = s.missed[1:]
+	}
+	s.missed = append(s.missed, m)
+	return true
+}
+
+// attach adds a connection to a local client and returns the client served
+// by its request loop and the messages missed while the client was
+// detached, assumes clients and sessions locks are held
+func attach(cl client, conn *mirc.Connection) (*client, []*mirc.Message) {
+	if len(cl.Devices) == 0 {
+		cl.IP = conn.RemoteAddr()
+	}
+	cl.Devices = append(append([]*mirc.Connection{}, cl.Devices...), conn)
+	cl.Socket = cl.Devices[0]
+	cl.LastActive = time.Now()
+	clients.list[fold(cl.Nick)] = cl
+	var missed []*mirc.Message
+	if s, ok := sessions.byNick[fold(cl.Nick)]; ok {
+		if s.expire != nil {
+			s.expire.Stop()
+			s.expire = nil
+		}
+		missed = s.missed
+		s.missed = nil
+	}
+	loop := cl
+	loop.Socket = conn
+	loop.Devices = nil
+	return &loop, missed
+}
+
+// leave removes the connection of a request loop from its client and
+// returns how many connections the client has left
+func (c *client) leave() int {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	cl, ok := clients.list[fold(c.Nick)]
+	if !ok {
+		return 0
+	}
+	var devices []*mirc.Connection
+	for _, d := range cl.Devices {
+		if d != c.Socket {
+			devices = append(devices, d)
+		}
+	}
+	cl.Devices = devices
+	cl.Socket = nil
+	if len(devices) > 0 {
+		cl.Socket = devices[0]
+	}
+	clients.list[fold(c.Nick)] = cl
+	return len(devices)
+}
+
+// detach keeps a client whose last connection dropped for the grace period,
+// it reports false if the client has no session and has to be removed
+func (c *client) detach() bool {
+	grace := currentConfig().ResumeGrace
+	if grace <= 0 {
+		return false
+	}
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	s, ok := sessions.byNick[fold(c.Nick)]
+	cl, exists := clients.list[fold(c.Nick)]
+	if !ok || !exists || len(cl.Devices) > 0 {
+		return false
+	}
+	if s.expire != nil {
+		// already detached by another of its connections
+		return true
+	}
+	s.expire = time.AfterFunc(time.Duration(grace)*time.Second, func() { expireSession(s) })
+	c.Socket.Conn.Close()
+	logInfo("client detached", "nick", c.Nick, "remote", c.Socket.RemoteAddr(), "grace", grace)
+	return true
+}
+
+// expireSession removes a detached client once its grace period is over
+func expireSession(s *session) {
+	clients.mu.Lock()
+	sessions.mu.Lock()
+	cl, ok := clients.list[fold(s.nick)]
+	expired := ok && len(cl.Devices) == 0 && sessions.byToken[s.token] == s
+	if expired {
+		delete(sessions.byToken, s.token)
+		delete(sessions.byNick, fold(s.nick))
+	}
+	sessions.mu.Unlock()
+	clients.mu.Unlock()
+	if !expired {
+		return
+	}
+	removeClient(cl.Nick, clients.list)
+	cl.disconnectHooks()
+	logInfo("session expired", "nick", cl.Nick)
+}
+
+// resumeSession attaches a new connection to the session of a token and
+// replays the messages the client missed. The token is replaced so it can
+// only be used once, the other devices of the client get the new one.
+func resumeSession(con *mirc.Connection, token string) (*client, error) {
+	next, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	clients.mu.Lock()
+	sessions.mu.Lock()
+	s, ok := sessions.byToken[token]
+	nick := ""
+	if ok {
+		nick = s.nick
+		_, ok = clients.list[fold(nick)]
+	}
+	if ok {
+		delete(sessions.byToken, token)
+		s.token = next
+		sessions.byToken[next] = s
+	}
+	sessions.mu.Unlock()
+	clients.mu.Unlock()
+	if !ok {
+		return nil, errors.New("invalid or expired resume token")
+	}
+	// the reply goes out before the connection is attached so it is the
+	// first message the client reads
+	if err := con.SendMsg(newMsg(mirc.CONNECTION_SUCCESS, nick, "Session resumed")); err != nil {
+		return nil, err
+	}
+	clients.mu.Lock()
+	sessions.mu.Lock()
+	cl, ok := clients.list[fold(s.nick)]
+	if !ok || sessions.byToken[next] != s {
+		sessions.mu.Unlock()
+		clients.mu.Unlock()
+		return nil, errors.New("session expired")
+	}
+	loop, missed := attach(cl, con)
+	all := clients.list[fold(loop.Nick)]
+	sessions.mu.Unlock()
+	clients.mu.Unlock()
+	all.send(newMsg(mirc.SERVER_RESUME_TOKEN, loop.Nick, next))
+	for _, m := range missed {
+		loop.send(m)
+	}
+	return loop, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestSessionBacklog(t *testing.T) {
+	token, err := sessions.open("Alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < resumeBacklog+10; i++ {
+		if !sessions.buffer("alice", mirc.NewMsg(mirc.SERVER_TELL_MESSAGE, "alice", "hi")) {
+			t.Fatal("message for a nick with a session was not kept")
+		}
+	}
+	if n := len(sessions.byToken[token].missed); n != resumeBacklog {
+		t.Errorf("expected %d missed messages, got %d", resumeBacklog, n)
+	}
+	sessions.rename("alice", "carol")
+	if sessions.byToken[token].nick != "carol" {
+		t.Error("session not moved to the new nick")
+	}
+	sessions.drop("CAROL")
+	if _, ok := sessions.byToken[token]; ok {
+		t.Error("dropped session can still be resumed")
+	}
+	if sessions.buffer("carol", mirc.NewMsg(mirc.SERVER_TELL_MESSAGE, "carol", "hi")) {
+		t.Error("message kept for a nick without a session")
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	savedClients := clients.list
+	defer func() { clients.list = savedClients }()
+	phone, phoneMsgs := testClient("alice", "10.0.0.1:5000")
+	clients.list = map[string]client{"alice": phone}
+	token, err := sessions.open("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.drop("alice")
+	sessions.buffer("alice", newMsg(mirc.SERVER_TELL_MESSAGE, "alice", "missed"))
+
+	laptop, laptopMsgs := testClient("alice", "10.0.0.2:5000")
+	if _, err := resumeSession(laptop.Socket, "wrong"); err == nil {
+		t.Error("resumed with a wrong token")
+	}
+	loop, err := resumeSession(laptop.Socket, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := <-laptopMsgs; m.Header.OpCode != mirc.CONNECTION_SUCCESS {
+		t.Errorf("expected the resume reply first, got %+v", m)
+	}
+	next := expectMsg(t, phoneMsgs, mirc.SERVER_RESUME_TOKEN).Body
+	if m := expectMsg(t, laptopMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "missed" {
+		t.Errorf("unexpected replay %+v", m)
+	}
+	if next == token || loop.Socket != laptop.Socket || len(clients.list["alice"].Devices) != 2 {
+		t.Errorf("session not resumed on the new connection")
+	}
+	if _, err := resumeSession(laptop.Socket, token); err == nil {
+		t.Error("resume token used twice")
+	}
+}
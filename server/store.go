@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// seconds between writes of state that changes often
+const flushInterval = 5
+
+// saveState writes v as json to name inside the data directory
+// nothing is written when persistence is disabled
+func saveState(name string, v interface{}) error {
+	dir := currentConfig().DataDir
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves half a file
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadState reads name from the data directory into v
+// a missing file leaves v untouched
+func loadState(name string, v interface{}) error {
+	dir := currentConfig().DataDir
+	if dir == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// flushState writes the state that is saved in batches if it changed
+func flushState() {
+	if err := markers.flush(); err != nil {
+		logError("cannot save read markers", "err", err)
+	}
+	if err := mentions.flush(); err != nil {
+		logError("cannot save mentions", "err", err)
+	}
+}
+
+// flushLoop writes batched state every flushInterval seconds and once more
+// when the server is stopped
+func flushLoop() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case <-time.After(flushInterval * time.Second):
+			flushState()
+		case <-stop:
+			flushState()
+			logInfo("server stopped")
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Typing notifications tell a room or a private message partner that someone
+// is writing. They are passed on as they come and never kept: they don't go
+// to history, webhooks or the backlog of a detached session. Clients that
+// don't want them opt out of the typing capability, every device of a nick
+// negotiates its capabilities on its own.
+
+// minimum seconds between two typing notifications of a client
+const typingInterval = 2
+
+/******************** types ********************/
+type typingThrottle struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// capsList locks after clientList
+type capsList struct {
+	mu sync.Mutex
+	// capabilities each connection opted out of
+	off map[*mirc.Connection][]string
+}
+
+/********************* Globals ******************/
+
+// optional features a client can opt out of, all are on by default
+var capabilities = []string{"typing"}
+
+// time of the last typing notification passed on by nick
+var typing = typingThrottle{
+	mu:   sync.Mutex{},
+	last: map[string]time.Time{},
+}
+
+// capabilities turned off by connection
+var deviceCaps = capsList{
+	mu:  sync.Mutex{},
+	off: map[*mirc.Connection][]string{},
+}
+
+/********************** Typing funtions *****************/
+// enabled reports whether a connection has not opted out of a capability
+func (l *capsList) enabled(conn *mirc.Connection, capability string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return contain(l.off[conn], capability) < 0
+}
+
+// turnedOff returns the capabilities a connection opted out of
+func (l *capsList) turnedOff(conn *mirc.Connection) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.off[conn]...)
+}
+
+// set replaces the capabilities a connection opted out of
+func (l *capsList) set(conn *mirc.Connection, off []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(off) == 0 {
+		delete(l.off, conn)
+		return
+	}
+	l.off[conn] = off
+}
+
+// forget drops the capabilities of a closed connection
+func (l *capsList) forget(conn *mirc.Connection) {
+	l.mu.Lock()
+	delete(l.off, conn)
+	l.mu.Unlock()
+}
+
+// capable reports whether the connection of a request loop has not opted
+// out of a capability
+func (c *client) capable(capability string) bool {
+	return deviceCaps.enabled(c.Socket, capability)
+}
+
+// allow reports whether a typing notification of nick may be passed on
+func (t *typingThrottle) allow(nick string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.last[fold(nick)]) < typingInterval*time.Second {
+		return false
+	}
+	t.last[fold(nick)] = now
+	return true
+}
+
+// forget drops the throttle state of a nick
+func (t *typingThrottle) forget(nick string) {
+	t.mu.Lock()
+	delete(t.last, fold(nick))
+	t.mu.Unlock()
+}
+
+// typingDevices keeps the devices of a local client that take typing
+// notifications, detached clients would only buffer them. It reports whether
+// any device is left
+func typingDevices(c *client) bool {
+	var devices []*mirc.Connection
+	for _, d := range c.Devices {
+		if deviceCaps.enabled(d, "typing") {
+			devices = append(devices, d)
+		}
+	}
+	c.Devices = devices
+	return len(devices) > 0
+}
+
+// deliverTyping passes a typing notification to the room members other than
+// the sender and to the links with members behind them, except the link it
+// came from
+func deliverTyping(m *mirc.Message, from string) {
+	rooms.mu.Lock()
+	r, ok := rooms.list[fold(m.Header.Receiver)]
+	rooms.unlock()
+	if !ok || containFold(r.Members, m.Header.Sender) < 0 {
+		return
+	}
+	var receivers []client
+	relays := map[string]bool{}
+	clients.mu.Lock()
+	for _, cNick := range r.Members {
+		c, ok := clients.list[fold(cNick)]
+		if !ok || fold(cNick) == fold(m.Header.Sender) {
+			continue
+		}
+		if c.Server == "" {
+			if typingDevices(&c) && !ignores.ignoring(c.Nick, m.Header.Sender) {
+				receivers = append(receivers, c)
+			}
+		} else if c.Server != from {
+			relays[c.Server] = true
+		}
+	}
+	clients.mu.Unlock()
+	for _, c := range receivers {
+		c.send(m)
+	}
+	for name := range relays {
+		links.relay(name, m)
+	}
+}
+
+// typingHandler passes on a typing notification, the receiver field holds
+// the room or the nick the client is writing to
+func (c *client) typingHandler(m *mirc.Message) {
+	if !typing.allow(c.Nick) {
+		return
+	}
+	msg := newMsg(mirc.SERVER_TYPING, m.Header.Receiver, "")
+	msg.Header.Sender = c.Nick
+	if c.inRoom(m.Header.Receiver) {
+		deliverTyping(msg, "")
+		return
+	}
+	clients.mu.Lock()
+	target, ok := clients.list[fold(m.Header.Receiver)]
+	clients.mu.Unlock()
+	if ok && target.Server == "" {
+		ok = typingDevices(&target)
+	}
+	if ok && !ignores.ignoring(target.Nick, c.Nick) {
+		msg.Header.Receiver = target.Nick
+		target.send(msg)
+	}
+}
+
+// capsHandler turns capabilities on and off, the body lists capability names
+// and a name starting with "-" opts out of it. The reply lists the
+// capabilities that are on
+func (c *client) capsHandler(m *mirc.Message) {
+	noCaps := deviceCaps.turnedOff(c.Socket)
+	for _, name := range strings.Fields(m.Body) {
+		off := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if contain(capabilities, name) < 0 {
+			c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "unknown capability "+name))
+			return
+		}
+		if i := contain(noCaps, name); off && i < 0 {
+			noCaps = append(noCaps, name)
+		} else if !off && i >= 0 {
+			noCaps = append(noCaps[:i], noCaps[i+1:]...)
+		}
+	}
+	deviceCaps.set(c.Socket, noCaps)
+	c.send(newMsg(mirc.SERVER_RPL_CAPS, c.Nick, strings.Join(c.enabledCaps(), " ")))
+}
+
+// enabledCaps lists the capabilities the client has not opted out of
+func (c *client) enabledCaps() []string {
+	var enabled []string
+	for _, name := range capabilities {
+		if c.capable(name) {
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled
+}
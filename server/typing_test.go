@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestTypingThrottle(t *testing.T) {
+	tt := typingThrottle{last: map[string]time.Time{}}
+	if !tt.allow("alice") {
+		t.Fatal("first notification was throttled")
+	}
+	if tt.allow("Alice") {
+		t.Error("second notification was not throttled")
+	}
+	tt.forget("alice")
+	if !tt.allow("alice") {
+		t.Error("notification throttled after forget")
+	}
+}
+
+func TestCapsHandler(t *testing.T) {
+	savedClients, savedRooms := clients.list, rooms.list
+	defer func() { clients.list, rooms.list = savedClients, savedRooms }()
+	phone, phoneMsgs := testClient("alice", "10.0.0.1:5000")
+	laptop, laptopMsgs := testClient("alice", "10.0.0.2:5000")
+	bob, _ := testClient("bob", "10.0.0.3:5000")
+	alice := phone
+	alice.Devices = []*mirc.Connection{phone.Socket, laptop.Socket}
+	clients.list = map[string]client{"alice": alice, "bob": bob}
+	rooms.list = map[string]room{"lobby": {Name: "lobby", Members: []string{"alice", "bob"}}}
+	defer deviceCaps.forget(phone.Socket)
+
+	phone.capsHandler(mirc.NewMsg(mirc.CLIENT_CAPS, "server", "-typing"))
+	if phone.capable("typing") || !laptop.capable("typing") {
+		t.Error("typing not turned off for the phone only")
+	}
+	expectMsg(t, phoneMsgs, mirc.SERVER_RPL_CAPS)
+	m := newMsg(mirc.SERVER_TYPING, "lobby", "")
+	m.Header.Sender = "bob"
+	deliverTyping(m, "")
+	expectMsg(t, laptopMsgs, mirc.SERVER_TYPING)
+	select {
+	case m := <-phoneMsgs:
+		t.Errorf("typing sent to a device that opted out: %+v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+	phone.capsHandler(mirc.NewMsg(mirc.CLIENT_CAPS, "server", "typing"))
+	if !phone.capable("typing") {
+		t.Error("typing still off after opting in")
+	}
+	phone.capsHandler(mirc.NewMsg(mirc.CLIENT_CAPS, "server", "-colors"))
+	if len(deviceCaps.turnedOff(phone.Socket)) != 0 {
+		t.Error("unknown capability was recorded")
+	}
+}
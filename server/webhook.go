@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+// Webhook defaults
+const webhookTimeout = 5
+const webhookRetries = 3
+const webhookQueue = 100
+
+// first retry delay, doubled after every failed attempt
+var webhookBackoff = time.Second
+
+/******************** types ********************/
+// webhookPayload is the json body posted for every room message
+type webhookPayload struct {
+	ID        int64     `json:"id"`
+	Room      string    `json:"room"`
+	Sender    string    `json:"sender"`
+	Body      string    `json:"body"`
+	Timestamp time.Time `json:"timestamp"`
+	Parent    int64     `json:"parent,omitempty"`
+}
+
+// webhook posts the messages of one room to a url from its own goroutine so
+// a slow endpoint never holds up the broadcast
+type webhook struct {
+	conf   webhookConf
+	client *http.Client
+	queue  chan []byte
+}
+type webhookList struct {
+	mu     sync.Mutex
+	byRoom map[string][]*webhook
+}
+
+/********************* Globals ******************/
+
+// outgoing webhooks by room name
+var webhooks = webhookList{
+	mu:     sync.Mutex{},
+	byRoom: map[string][]*webhook{},
+}
+
+/********************** Webhook funtions *****************/
+// newWebhook fills in defaults for a configured webhook
+func newWebhook(conf webhookConf) *webhook {
+	if conf.Timeout <= 0 {
+		conf.Timeout = webhookTimeout
+	}
+	if conf.Retries < 0 {
+		conf.Retries = 0
+	} else if conf.Retries == 0 {
+		conf.Retries = webhookRetries
+	}
+	return &webhook{
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+		queue:  make(chan []byte, webhookQueue),
+	}
+}
+
+// startWebhooks starts a worker for every configured webhook, the workers of
+// the webhooks started before finish their queue and stop
+func startWebhooks(confs []webhookConf) {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	for _, list := range webhooks.byRoom {
+		for _, w := range list {
+			close(w.queue)
+		}
+	}
+	webhooks.byRoom = map[string][]*webhook{}
+	for _, conf := range confs {
+		w := newWebhook(conf)
+		webhooks.byRoom[fold(conf.Room)] = append(webhooks.byRoom[fold(conf.Room)], w)
+		go w.run()
+	}
+}
+
+// notifyWebhooks queues a broadcast message for the webhooks of its room,
+// notices of the server are not posted
+func notifyWebhooks(m *mirc.Message) {
+	if m.Header.Sender == "server" {
+		return
+	}
+	webhooks.mu.Lock()
+	n := len(webhooks.byRoom[fold(m.Header.Receiver)])
+	webhooks.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	payload, err := json.Marshal(webhookPayload{
+		ID:        m.Header.ID,
+		Room:      m.Header.Receiver,
+		Sender:    m.Header.Sender,
+		Body:      m.Body,
+		Timestamp: m.Header.Time,
+		Parent:    m.Header.Parent,
+	})
+	if err != nil {
+		logError("cannot encode webhook payload", "room", m.Header.Receiver, "err", err)
+		return
+	}
+	// queues are closed with the lock held when the webhooks are reloaded
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	for _, w := range webhooks.byRoom[fold(m.Header.Receiver)] {
+		select {
+		case w.queue <- payload:
+		default:
+			metrics.webhooks.inc("dropped")
+			logWarn("webhook queue full, message dropped", "room", w.conf.Room, "url", w.conf.URL, "id", m.Header.ID)
+		}
+	}
+}
+
+// signPayload returns the value of the signature header for a payload
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// run delivers queued payloads one at a time, retrying failures
+func (w *webhook) run() {
+	for payload := range w.queue {
+		delay := webhookBackoff
+		err := w.post(payload)
+		for attempt := 0; err != nil && attempt < w.conf.Retries; attempt++ {
+			time.Sleep(delay)
+			delay *= 2
+			err = w.post(payload)
+		}
+		if err != nil {
+			metrics.webhooks.inc("failed")
+			logWarn("webhook delivery failed", "room", w.conf.Room, "url", w.conf.URL, "err", err)
+		} else {
+			metrics.webhooks.inc("delivered")
+		}
+	}
+}
+
+// post sends one payload, any status other than 2xx is an error
+func (w *webhook) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.conf.Secret != "" {
+		req.Header.Set("X-Mirc-Signature", signPayload(w.conf.Secret, payload))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("unexpected status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	calls := 0
+	received := make(chan webhookPayload, 1)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// fail the first attempt to exercise the retry
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Mirc-Signature") != signPayload("s3cret", body) {
+			t.Error("signature header doesn't match the body")
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error(err)
+		}
+		received <- p
+	}))
+	defer stub.Close()
+
+	w := newWebhook(webhookConf{Room: "deploys", URL: stub.URL, Secret: "s3cret"})
+	go w.run()
+	webhooks.byRoom["deploys"] = []*webhook{w}
+	defer delete(webhooks.byRoom, "deploys")
+
+	notice := newMsg(mirc.SERVER_BROADCAST_MESSAGE, "deploys", "ci joined deploys")
+	notice.Header.ID = 41
+	notifyWebhooks(notice)
+	m := mirc.NewMsg(mirc.SERVER_BROADCAST_MESSAGE, "deploys", "v1.2 is live")
+	m.Header.Sender = "ci"
+	m.Header.ID = 42
+	m.Header.Time = time.Now()
+	notifyWebhooks(m)
+
+	select {
+	case p := <-received:
+		if p.ID != 42 || p.Room != "deploys" || p.Sender != "ci" || p.Body != "v1.2 is live" {
+			t.Errorf("unexpected payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	if calls != 2 {
+		t.Errorf("expected one retry, got %d calls", calls)
+	}
+}
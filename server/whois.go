@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/shaynewang/mirc"
+)
+
+// whoisHandler replies with the details of the nick in the body
+// the address is only shown to operators
+func (c *client) whoisHandler(m *mirc.Message) {
+	clients.mu.Lock()
+	target, ok := clients.list[fold(m.Body)]
+	clients.mu.Unlock()
+	if !ok {
+		c.send(newMsg(mirc.SERVER_TELL_MESSAGE, c.Nick, "no such nick "+m.Body))
+		return
+	}
+	rooms.mu.Lock()
+	info := clientInfo(target)
+	// secret rooms are only shown to their members
+	visible := []string{}
+	for _, name := range info.Rooms {
+		if r := rooms.list[fold(name)]; r.visibleTo(c) {
+			visible = append(visible, name)
+		}
+	}
+	info.Rooms = visible
+	rooms.unlock()
+	if !c.Oper {
+		info.IP = ""
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		logError("cannot encode whois reply", "nick", m.Body, "err", err)
+		return
+	}
+	c.send(newMsg(mirc.SERVER_RPL_WHOIS, c.Nick, string(body)))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/shaynewang/mirc"
+)
+
+func TestWhois(t *testing.T) {
+	savedConf, savedClients, savedRooms := config, clients.list, rooms.list
+	defer func() { config, clients.list, rooms.list = savedConf, savedClients, savedRooms }()
+	config.DataDir = ""
+	alice, aliceMsgs := testClient("alice", "10.0.0.1:5000")
+	bob, bobMsgs := testClient("bob", "10.0.0.2:5000")
+	bob.Oper = true
+	carol, _ := testClient("carol", "192.168.1.1:5000")
+	carol.Connected = time.Now().Add(-time.Hour)
+	carol.LastActive = time.Now().Add(-time.Minute)
+	carol.Away = "lunch"
+	clients.list = map[string]client{"alice": alice, "bob": bob, "carol": carol}
+	rooms.list = map[string]room{
+		"public": {Name: "public", Members: []string{"server", "alice", "carol"}},
+		"ops":    {Name: "ops", Members: []string{"carol"}, Modes: "s"},
+	}
+	whois := func(c client, received chan *mirc.Message, nick string) mirc.ClientInfo {
+		c.whoisHandler(mirc.NewMsg(mirc.CLIENT_WHOIS, "", nick))
+		var info mirc.ClientInfo
+		if err := json.Unmarshal([]byte(expectMsg(t, received, mirc.SERVER_RPL_WHOIS).Body), &info); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	info := whois(alice, aliceMsgs, "CAROL")
+	if info.Nick != "carol" || info.Away != "lunch" || info.IdleSeconds < 60 || !info.Connected.Equal(carol.Connected) {
+		t.Errorf("unexpected whois reply %+v", info)
+	}
+	if info.IP != "" {
+		t.Errorf("address shown to a regular user: %q", info.IP)
+	}
+	if len(info.Rooms) != 1 || info.Rooms[0] != "public" {
+		t.Errorf("secret room shown to a non-member: %v", info.Rooms)
+	}
+	info = whois(bob, bobMsgs, "carol")
+	if info.IP != "192.168.1.1" {
+		t.Errorf("address not shown to an operator: %q", info.IP)
+	}
+	if len(info.Rooms) != 2 {
+		t.Errorf("operator doesn't see the secret room: %v", info.Rooms)
+	}
+	alice.whoisHandler(mirc.NewMsg(mirc.CLIENT_WHOIS, "", "dave"))
+	if m := expectMsg(t, aliceMsgs, mirc.SERVER_TELL_MESSAGE); m.Body != "no such nick dave" {
+		t.Errorf("unexpected reply %q", m.Body)
+	}
+}
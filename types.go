@@ -1,7 +1,9 @@
 package mirc
 
 import (
+	"bufio"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -22,32 +24,184 @@ const (
 	CLIENT_SEND_PUB_MESSAGE   = 107
 	CLIENT_CHANGE_NICK        = 108
 	CLIENT_IN_ROOM            = 109
+	CLIENT_OPER               = 110
+	CLIENT_KILL               = 111
+	CLIENT_WALL               = 112
+	CLIENT_DELETE_ROOM        = 113
+	CLIENT_FORCE_JOIN         = 114
+	CLIENT_FORCE_PART         = 115
+	CLIENT_BAN                = 116
+	CLIENT_UNBAN              = 117
+	CLIENT_LIST_BANS          = 118
+	CLIENT_CREATE_HOOK        = 119
+	CLIENT_REVOKE_HOOK        = 120
+	CLIENT_LIST_HOOKS         = 121
+	CLIENT_AWAY               = 122
+	CLIENT_WHOIS              = 123
+	CLIENT_RESUME             = 124
+	CLIENT_REGISTER           = 125
+	CLIENT_LOGIN              = 126
+	CLIENT_EDIT_MESSAGE       = 127
+	CLIENT_DELETE_MESSAGE     = 128
+	CLIENT_GET_THREAD         = 129
+	CLIENT_CAPS               = 130
+	CLIENT_TYPING             = 131
+	CLIENT_MARK_READ          = 132
+	CLIENT_LIST_MENTIONS      = 133
+	CLIENT_SEARCH             = 134
+	CLIENT_SET_TOPIC          = 135
+	CLIENT_SET_MODE           = 136
+	CLIENT_SCHEDULE           = 137
+	CLIENT_UNSCHEDULE         = 138
+	CLIENT_LIST_SCHEDULES     = 139
+	CLIENT_IGNORE             = 140
+	CLIENT_UNIGNORE           = 141
+	CLIENT_LIST_IGNORES       = 142
 	SERVER_RPL_LIST_ROOM      = 204
 	SERVER_RPL_LIST_MEMBER    = 205
 	SERVER_TELL_MESSAGE       = 206
 	SERVER_BROADCAST_MESSAGE  = 207
 	SERVER_RPL_CLIENT_IN_ROOM = 208
+	SERVER_WALL_MESSAGE       = 209
+	SERVER_RPL_LIST_BANS      = 210
+	SERVER_RPL_LIST_HOOKS     = 211
+	SERVER_RPL_WHOIS          = 212
+	SERVER_RPL_NICK           = 213
+	SERVER_RESUME_TOKEN       = 214
+	SERVER_MESSAGE_EDITED     = 215
+	SERVER_MESSAGE_DELETED    = 216
+	SERVER_RPL_THREAD         = 217
+	SERVER_RPL_CAPS           = 218
+	SERVER_TYPING             = 219
+	SERVER_READ_MARKER        = 220
+	SERVER_RPL_MENTIONS       = 221
+	SERVER_RPL_SEARCH         = 222
+	SERVER_RPL_LIST_SCHEDULES = 223
+	SERVER_RPL_LIST_IGNORES   = 224
+	SERVER_LINK               = 300
+	SERVER_LINK_NICK          = 301
+	SERVER_LINK_QUIT          = 302
+	SERVER_LINK_JOIN          = 303
+	SERVER_LINK_PART          = 304
+	SERVER_LINK_ROUTE         = 305
+	SERVER_LINK_AWAY          = 306
+	SERVER_LINK_RENAME        = 307
+	SERVER_LINK_KILL          = 308
 	ERROR                     = 1000
 )
 
 // Connection type contains the connection object
 type Connection struct {
 	net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
 }
 
-// Client type contains information of clients in server
+// Client type contains information of clients in server. Timeout is set when
+// the client connects but not read by the server, idle clients are found
+// through LastActive
 type Client struct {
 	IP      net.Addr
 	Nick    string
 	Room    string
 	Timeout time.Time
 	Socket  *Connection
+	Oper    bool
+	// name of the linked server the client is reached through,
+	// empty for clients connected to this server
+	Server string
+	// time the client connected and the time of its last request
+	Connected  time.Time
+	LastActive time.Time
+	// away message, empty when the client is present
+	Away     string
+	AutoAway bool
+	// every connection of a local client, a logged in nick can be connected
+	// from several devices. Socket is the connection a request loop serves
+	Devices []*Connection
+	// number of the connection that took the nick, it stays with the client
+	// across nick changes and resumes. Zero for clients of linked servers
+	ConnID int64
 }
 
 // Room type contains the room name and the list of memebers
 type Room struct {
 	Name    string
 	Members []string
+	Topic   string
+	Created time.Time
+	// room operators, the creator of a room is its first operator
+	Ops []string
+	// mode letters set on the room
+	Modes string
+}
+
+// RoomInfo describes a room to clients and monitoring tools
+type RoomInfo struct {
+	Name        string    `json:"name"`
+	MemberCount int       `json:"memberCount"`
+	Members     []string  `json:"members,omitempty"`
+	Topic       string    `json:"topic"`
+	Modes       string    `json:"modes,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// RoomList is a page of the room list
+type RoomList struct {
+	Page  int        `json:"page"`
+	Pages int        `json:"pages"`
+	Total int        `json:"total"`
+	Rooms []RoomInfo `json:"rooms"`
+}
+
+// HistoryMessage is a room message kept by the server
+type HistoryMessage struct {
+	ID      int64     `json:"id"`
+	Room    string    `json:"room"`
+	Sender  string    `json:"sender"`
+	Body    string    `json:"body"`
+	Time    time.Time `json:"time"`
+	Parent  int64     `json:"parent,omitempty"`
+	Replies int       `json:"replies,omitempty"`
+	Edited  bool      `json:"edited,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+	// who may change the message, kept on the server only
+	Author string `json:"-"`
+}
+
+// SearchResult is a page of messages found by a search, newest first
+type SearchResult struct {
+	Query string      `json:"query"`
+	Page  int         `json:"page"`
+	Pages int         `json:"pages"`
+	Total int         `json:"total"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+// SearchHit is a message found by a search with the messages around it
+type SearchHit struct {
+	Message HistoryMessage   `json:"message"`
+	Before  []HistoryMessage `json:"before,omitempty"`
+	After   []HistoryMessage `json:"after,omitempty"`
+}
+
+// ReadMarker tells a client how far it has read a room
+type ReadMarker struct {
+	Room        string `json:"room"`
+	LastRead    int64  `json:"lastRead"`
+	Unread      int    `json:"unread"`
+	FirstUnread int64  `json:"firstUnread,omitempty"`
+}
+
+// ClientInfo describes a connected client to clients and monitoring tools
+type ClientInfo struct {
+	Nick        string    `json:"nick"`
+	IP          string    `json:"ip,omitempty"`
+	Server      string    `json:"server,omitempty"`
+	Rooms       []string  `json:"rooms"`
+	Connected   time.Time `json:"connected"`
+	IdleSeconds int       `json:"idleSeconds"`
+	Away        string    `json:"away,omitempty"`
 }
 
 // MsgHeader contains header information of messages
@@ -57,6 +211,11 @@ type MsgHeader struct {
 	Receiver string
 	MsgLen   int
 	Timeout  int
+	// ID and Time are stamped by the server on room and private messages
+	ID   int64
+	Time time.Time
+	// id of the message a room message replies to, 0 outside threads
+	Parent int64
 }
 
 // Message contain the header object as well as the body of a message
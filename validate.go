@@ -0,0 +1,64 @@
+package mirc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Name limits
+const MaxNickLen = 16
+const MaxRoomLen = 32
+
+// names nobody can take, compared case-insensitively
+var reservedNames = []string{"server"}
+
+// CanonicalName returns the key a nick or room name is stored under, names
+// that only differ by case are the same name
+func CanonicalName(name string) string {
+	return strings.ToLower(name)
+}
+
+// ValidateNick checks that a nickname is safe to register, nicks start with
+// a letter followed by letters, digits, '-' or '_'
+func ValidateNick(nick string) error {
+	if err := validateName("nickname", nick, MaxNickLen, "-_"); err != nil {
+		return err
+	}
+	if !isLetter(rune(nick[0])) {
+		return errors.New("nickname must start with a letter")
+	}
+	return nil
+}
+
+// ValidateRoom checks that a room name is safe to register, room names are
+// letters, digits, '-', '_', '.' or '#'
+func ValidateRoom(name string) error {
+	return validateName("room name", name, MaxRoomLen, "-_.#")
+}
+
+// validateName checks length, charset and reserved names
+func validateName(kind string, name string, max int, extra string) error {
+	if name == "" {
+		return errors.New(kind + " cannot be empty")
+	}
+	if len(name) > max {
+		return fmt.Errorf("%s cannot be longer than %d characters", kind, max)
+	}
+	for _, r := range name {
+		if !isLetter(r) && !(r >= '0' && r <= '9') && !strings.ContainsRune(extra, r) {
+			return fmt.Errorf("%s cannot contain %q", kind, r)
+		}
+	}
+	for _, reserved := range reservedNames {
+		if CanonicalName(name) == reserved {
+			return errors.New(kind + " " + name + " is reserved")
+		}
+	}
+	return nil
+}
+
+// isLetter reports whether r is an ascii letter
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
@@ -0,0 +1,60 @@
+package mirc
+
+import "testing"
+
+func TestValidateNick(t *testing.T) {
+	var tests = []struct {
+		nick  string
+		valid bool
+	}{
+		{"alice", true},
+		{"Bob_2", true},
+		{"x-ray", true},
+		{"", false},
+		{"   ", false},
+		{"evil\nnick", false},
+		{"tab\tnick", false},
+		{"2fast", false},
+		{"_alice", false},
+		{"server", false},
+		{"SERVER", false},
+		{"averyveryverylongnick", false},
+		{"émile", false},
+		{"@alice", false},
+	}
+	for _, test := range tests {
+		if err := ValidateNick(test.nick); (err == nil) != test.valid {
+			t.Errorf("ValidateNick(%q) = %v, expected valid %v", test.nick, err, test.valid)
+		}
+	}
+}
+
+func TestValidateRoom(t *testing.T) {
+	var tests = []struct {
+		name  string
+		valid bool
+	}{
+		{"public", true},
+		{"#go", true},
+		{"release-1.2", true},
+		{"", false},
+		{"two words", false},
+		{"Server", false},
+		{"bell\a", false},
+		{"abcdefghijklmnopqrstuvwxyz0123456789", false},
+	}
+	for _, test := range tests {
+		if err := ValidateRoom(test.name); (err == nil) != test.valid {
+			t.Errorf("ValidateRoom(%q) = %v, expected valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	if CanonicalName("Alice") != CanonicalName("aLICE") {
+		t.Error("names differing by case have different keys")
+	}
+	if CanonicalName("alice") == CanonicalName("alice2") {
+		t.Error("different names have the same key")
+	}
+}